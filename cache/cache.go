@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Cache is the contract between the proxy and a cache engine. Implementations
+// must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value of the key, iff it exists and hasn't expired, and
+	// a boolean for checking existence.
+	Get(key string) (interface{}, bool)
+	// GetStale returns the value of the key even if it has expired, as long
+	// as it's within the grace window, see Options.StaleGrace. It's for use
+	// when the value can't be fetched again.
+	GetStale(key string) (interface{}, bool)
+	// Add inserts or replaces the value of the key. The entry expires after
+	// ttl or the cache's own TTL, whichever is shorter. A ttl of zero means
+	// the cache's TTL.
+	Add(key string, val interface{}, ttl time.Duration)
+	// Remove deletes the key, if it exists.
+	Remove(key string)
+	// Len returns the number of entries cached.
+	Len() int
+	// Stats returns a snapshot of the cache's counters.
+	Stats() Stats
+	// Flush removes every entry.
+	Flush()
+	// Start begins expiring entries in the background. Stop must be called to
+	// allow the cache to be garbage collected.
+	Start()
+	Stop()
+	// SetRefresher sets the function called to refresh an entry that is past
+	// its soft TTL, see Options.SoftTTL. It is called with the cache locked,
+	// so it must not block or use the cache, and should refresh the entry in
+	// the background by adding it again. It must be set before the cache is
+	// used.
+	SetRefresher(refresh func(key string))
+}
+
+// Stats is a snapshot of a cache's counters.
+type Stats struct {
+	// The number of lookups that found, or did not find, their key.
+	Hits   uint64
+	Misses uint64
+	// The number of entries currently cached, and their estimated size in
+	// bytes. See entrySize.
+	Len   int
+	Bytes int64
+}
+
+// The cache engines that can be selected with Options.Engine.
+const (
+	EngineLRU     = "lru"
+	EngineLFU     = "lfu"
+	EngineTinyLFU = "tinylfu"
+	EngineNone    = "none"
+)
+
+// Options configures a cache created by NewCache.
+type Options struct {
+	// Engine selects the eviction policy, one of the Engine constants.
+	Engine string
+	// The maximum number of entries to cache, or zero for no limit.
+	Capacity int
+	// The maximum estimated size of the cached entries in bytes, or zero for
+	// no limit. Both limits apply when both are set.
+	MaxMemory int64
+	// The periodicity of the expiry routine.
+	Period time.Duration
+	// The default, and longest, TTL of an entry.
+	TTL time.Duration
+	// The number of shards to split the cache into, each with its own lock
+	// and an even share of the limits. Zero or one leaves it unsharded.
+	Shards int
+	// Expired entries are kept for StaleGrace, only to be returned by
+	// GetStale. Zero removes them as soon as they expire.
+	StaleGrace time.Duration
+	// Entries older than SoftTTL are still returned by Get, but the first Get
+	// after it asks the refresher to fetch the entry again. Entries are only
+	// removed once their TTL has passed. Zero disables refreshing.
+	SoftTTL time.Duration
+	// Entries read at least RefreshAhead times are refreshed a little before
+	// their SoftTTL, so that hot keys are never served stale. Zero disables
+	// refreshing ahead.
+	RefreshAhead int
+}
+
+// NewCache returns a cache using the engine selected by opt, split into
+// opt.Shards shards if there's more than one.
+func NewCache(opt *Options) (Cache, error) {
+	if opt.Engine == EngineNone {
+		return &NoopCache{}, nil
+	}
+	if opt.Shards <= 1 {
+		return newEngine(opt, opt.Capacity, opt.MaxMemory)
+	}
+
+	// The limits are shared out between the shards, rounding up.
+	capacity := (opt.Capacity + opt.Shards - 1) / opt.Shards
+	maxMemory := (opt.MaxMemory + int64(opt.Shards) - 1) / int64(opt.Shards)
+	shards := make([]Cache, opt.Shards)
+	for i := range shards {
+		shard, err := newEngine(opt, capacity, maxMemory)
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = shard
+	}
+	return NewShardedCache(shards)
+}
+
+// newEngine returns a single, unsharded, cache of the engine selected by opt,
+// with the given limits.
+func newEngine(opt *Options, capacity int, maxMemory int64) (Cache, error) {
+	var cache Cache
+	var d *decay
+	switch opt.Engine {
+	case EngineLRU, "":
+		lru, err := NewDecayingLRUCache(capacity, opt.Period, opt.TTL)
+		if err != nil {
+			return nil, err
+		}
+		lru.maxMemory = maxMemory
+		cache, d = lru, &lru.decay
+	case EngineLFU:
+		lfu, err := NewDecayingLFUCache(capacity, opt.Period, opt.TTL)
+		if err != nil {
+			return nil, err
+		}
+		lfu.maxMemory = maxMemory
+		cache, d = lfu, &lfu.decay
+	case EngineTinyLFU:
+		tiny, err := NewTinyLFUCache(capacity, opt.Period, opt.TTL)
+		if err != nil {
+			return nil, err
+		}
+		tiny.maxMemory = maxMemory
+		cache, d = tiny, &tiny.decay
+	default:
+		return nil, fmt.Errorf("Unknown cache engine %q", opt.Engine)
+	}
+	d.grace = opt.StaleGrace
+	d.softTTL = opt.SoftTTL
+	d.refreshAhead = opt.RefreshAhead
+	return cache, nil
+}
+
+// entryOverhead approximates the memory used by an entry besides its key and
+// value: the element itself, its list and hashmap nodes, and its item in the
+// expiration index.
+const entryOverhead = 192
+
+// entrySize estimates the memory used by caching val under key. Only strings
+// and byte slices, which is all the proxy caches, are measured; other values
+// are counted as a pointer.
+func entrySize(key string, val interface{}) int64 {
+	size := int64(len(key) + entryOverhead)
+	switch val := val.(type) {
+	case string:
+		size += int64(len(val))
+	case []byte:
+		size += int64(len(val))
+	default:
+		size += 8
+	}
+	return size
+}
+
+// hashKey hashes a key with 64 bit FNV-1a, inlined to avoid allocating on
+// every lookup.
+func hashKey(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	hash := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= prime64
+	}
+	return hash
+}
+
+// NoopCache caches nothing, so every lookup is a miss. It lets the proxy run
+// as a pure router.
+type NoopCache struct {
+	misses uint64
+}
+
+// Get always misses.
+func (cache *NoopCache) Get(key string) (interface{}, bool) {
+	atomic.AddUint64(&cache.misses, 1)
+	return nil, false
+}
+
+// GetStale always misses.
+func (cache *NoopCache) GetStale(key string) (interface{}, bool) {
+	return nil, false
+}
+
+// Add does nothing.
+func (cache *NoopCache) Add(key string, val interface{}, ttl time.Duration) {}
+
+// Remove does nothing.
+func (cache *NoopCache) Remove(key string) {}
+
+// Len is always zero.
+func (cache *NoopCache) Len() int {
+	return 0
+}
+
+// Stats only counts misses.
+func (cache *NoopCache) Stats() Stats {
+	return Stats{Misses: atomic.LoadUint64(&cache.misses)}
+}
+
+// Flush does nothing.
+func (cache *NoopCache) Flush() {}
+
+// Start does nothing.
+func (cache *NoopCache) Start() {}
+
+// Stop does nothing.
+func (cache *NoopCache) Stop() {}
+
+// SetRefresher does nothing, as there's nothing to refresh.
+func (cache *NoopCache) SetRefresher(refresh func(key string)) {}
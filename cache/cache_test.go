@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCache(t *testing.T) {
+	assert := assert.New(t)
+	opt := &Options{Capacity: 2, Period: time.Second, TTL: time.Minute}
+
+	c, err := NewCache(opt)
+	assert.Nil(err)
+	assert.IsType(&DecayingLRUCache{}, c)
+
+	opt.Engine = EngineLFU
+	c, err = NewCache(opt)
+	assert.Nil(err)
+	assert.IsType(&DecayingLFUCache{}, c)
+
+	opt.Engine = EngineTinyLFU
+	c, err = NewCache(opt)
+	assert.Nil(err)
+	assert.IsType(&TinyLFUCache{}, c)
+
+	opt.Engine = EngineNone
+	c, err = NewCache(opt)
+	assert.Nil(err)
+	assert.IsType(&NoopCache{}, c)
+
+	opt.Engine = "fifo"
+	c, err = NewCache(opt)
+	assert.Nil(c)
+	assert.Equal(`Unknown cache engine "fifo"`, err.Error())
+}
+
+func TestNoopCache(t *testing.T) {
+	assert := assert.New(t)
+	cache := &NoopCache{}
+
+	cache.Add("1", "test1", 0)
+	res, exists := cache.Get("1")
+	assert.Nil(res)
+	assert.False(exists)
+	assert.Equal(0, cache.Len())
+	assert.Equal(Stats{Misses: 1}, cache.Stats())
+}
+
+func TestSoftTTL(t *testing.T) {
+	for _, engine := range []string{EngineLRU, EngineLFU, EngineTinyLFU} {
+		assert := assert.New(t)
+		cache, err := NewCache(&Options{Engine: engine, Capacity: 10, Period: time.Second, TTL: time.Minute, SoftTTL: 50 * time.Millisecond})
+		assert.Nil(err)
+		var refreshed []string
+		cache.SetRefresher(func(key string) {
+			refreshed = append(refreshed, key)
+		})
+
+		cache.Add("1", "test1", 0)
+		cache.Get("1")
+		assert.Nil(refreshed, engine)
+
+		// Stale entries are still served, and refreshed once.
+		time.Sleep(60 * time.Millisecond)
+		res, exists := cache.Get("1")
+		assert.Equal("test1", res, engine)
+		assert.True(exists, engine)
+		cache.Get("1")
+		assert.Equal([]string{"1"}, refreshed, engine)
+
+		// The refresh adds the entry again, which makes it fresh.
+		cache.Add("1", "test1", 0)
+		cache.Get("1")
+		assert.Equal([]string{"1"}, refreshed, engine)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	assert := assert.New(t)
+	d := decay{softTTL: 100 * time.Second, refreshAhead: 3}
+	var refreshed []string
+	d.SetRefresher(func(key string) {
+		refreshed = append(refreshed, key)
+	})
+
+	// Times are passed in rather than read from the clock, so the window can
+	// be tested exactly.
+	written := time.Now()
+	var hot, cold refreshState
+	for i := 0; i < 3; i++ {
+		d.revalidate("hot", written, written.Add(time.Second), &hot)
+	}
+	assert.Nil(refreshed)
+
+	// Only the hot key is refreshed in the last fifth of its soft TTL.
+	d.revalidate("hot", written, written.Add(79*time.Second), &hot)
+	assert.Nil(refreshed)
+	d.revalidate("hot", written, written.Add(80*time.Second), &hot)
+	d.revalidate("cold", written, written.Add(80*time.Second), &cold)
+	assert.Equal([]string{"hot"}, refreshed)
+
+	// No other refresh is asked for while one may still be in progress.
+	d.revalidate("hot", written, written.Add(80*time.Second+refreshRetry/2), &hot)
+	assert.Equal([]string{"hot"}, refreshed)
+
+	// Once past the soft TTL every entry is refreshed.
+	d.revalidate("cold", written, written.Add(100*time.Second), &cold)
+	assert.Equal([]string{"hot", "cold"}, refreshed)
+}
+
+func TestStaleGrace(t *testing.T) {
+	for _, engine := range []string{EngineLRU, EngineLFU, EngineTinyLFU} {
+		assert := assert.New(t)
+		cache, err := NewCache(&Options{Engine: engine, Capacity: 10, Period: time.Millisecond, TTL: time.Minute, StaleGrace: 100 * time.Millisecond})
+		assert.Nil(err)
+		cache.Start()
+
+		cache.Add("1", "test1", 20*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+
+		// Expired entries miss, but are kept for the grace window.
+		_, exists := cache.Get("1")
+		assert.False(exists, engine)
+		res, exists := cache.GetStale("1")
+		assert.Equal("test1", res, engine)
+		assert.True(exists, engine)
+
+		time.Sleep(100 * time.Millisecond)
+		_, exists = cache.GetStale("1")
+		assert.False(exists, engine)
+		assert.Equal(0, cache.Len(), engine)
+		cache.Stop()
+	}
+}
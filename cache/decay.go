@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"time"
+)
+
+// decay drives the wall-clock expiry shared by the cache engines. It keeps an
+// index of the deadline of every entry, and a periodic 'redeemer' routine
+// removes the entries whose deadline has passed.
+//
+// The index is guarded by the lock of the cache that owns it, which must keep
+// it in step with its entries by calling schedule and unschedule.
+type decay struct {
+	index      *expiryIndex
+	ticker     *time.Ticker
+	stopTicker chan bool
+	ttl        time.Duration
+
+	// How long entries are kept past their deadline, see Options.StaleGrace.
+	grace time.Duration
+
+	// For stale-while-revalidate, see Options.SoftTTL.
+	softTTL      time.Duration
+	refreshAhead int
+	refresher    func(key string)
+}
+
+// refreshRetry is how long a refresh has to replace an entry before the next
+// read of it asks for another, e.g. because the backend was unavailable.
+const refreshRetry = time.Second
+
+// refreshState tracks the reads and refreshes of one entry. Each engine keeps
+// one in its elements, reset whenever the entry is written.
+type refreshState struct {
+	reads       int
+	refreshedAt time.Time
+}
+
+func newDecay(period time.Duration, ttl time.Duration) decay {
+	return decay{
+		index:      newExpiryIndex(),
+		ticker:     time.NewTicker(period),
+		stopTicker: make(chan bool),
+		ttl:        ttl,
+	}
+}
+
+// deadline returns when an entry written at timestamp, with the given TTL,
+// expires. Entries never outlive the cache's own TTL.
+func (d *decay) deadline(timestamp time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 || ttl > d.ttl {
+		ttl = d.ttl
+	}
+	return timestamp.Add(ttl)
+}
+
+// schedule sets the deadline of the key's entry, replacing any earlier one.
+// The entry is removed once the grace window after the deadline has passed
+// too.
+func (d *decay) schedule(key string, deadline time.Time) {
+	d.index.set(key, deadline.Add(d.grace))
+}
+
+// removable reports whether an entry with the given deadline is past both it
+// and the grace window, and so should be removed.
+func (d *decay) removable(deadline time.Time, now time.Time) bool {
+	return now.After(deadline.Add(d.grace))
+}
+
+// unschedule forgets the deadline of a key whose entry has been removed.
+func (d *decay) unschedule(key string) {
+	d.index.remove(key)
+}
+
+// expire calls removeIfAfter for every entry past its deadline and grace
+// window. The cache checks its own deadline for the key before removing it.
+func (d *decay) expire(now time.Time, removeIfAfter func(key string, after time.Time)) {
+	d.index.expired(now, func(key string) {
+		removeIfAfter(key, now)
+	})
+}
+
+// SetRefresher sets the function asked to refresh stale entries.
+func (d *decay) SetRefresher(refresh func(key string)) {
+	d.refresher = refresh
+}
+
+// revalidate records a read of an entry written at timestamp, and asks the
+// refresher to fetch it again if it's past the soft TTL, or nearly so for an
+// entry that's read often. Only one refresh is asked for at a time.
+func (d *decay) revalidate(key string, timestamp time.Time, now time.Time, state *refreshState) {
+	if d.softTTL <= 0 || d.refresher == nil {
+		return
+	}
+	state.reads++
+	if now.Sub(state.refreshedAt) < refreshRetry {
+		return
+	}
+
+	age := now.Sub(timestamp)
+	stale := age >= d.softTTL
+	// Hot entries are refreshed in the last fifth of their soft TTL.
+	ahead := d.refreshAhead > 0 && state.reads >= d.refreshAhead && age >= d.softTTL*4/5
+	if stale || ahead {
+		state.refreshedAt = now
+		d.refresher(key)
+	}
+}
+
+// redeemer calls tick with the current time every period until stopped.
+func (d *decay) redeemer(tick func(now time.Time)) {
+	for {
+		select {
+		case now := <-d.ticker.C:
+			tick(now)
+		case <-d.stopTicker:
+			d.ticker.Stop()
+			return
+		}
+	}
+}
+
+func (d *decay) stop() {
+	d.stopTicker <- true
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryItem is the deadline of one cache entry in an expiryIndex.
+type expiryItem struct {
+	key      string
+	deadline time.Time
+	// The item's position in the heap, maintained by expiryHeap.
+	index int
+}
+
+// expiryHeap is a min-heap of items ordered by deadline. It implements
+// heap.Interface and shouldn't be used directly.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// expiryIndex tracks the deadline of every entry in a cache, so that expired
+// entries can be found without scanning. It holds exactly one item per entry:
+// setting the deadline of a key that's already indexed moves it, in
+// logarithmic time, rather than adding another.
+type expiryIndex struct {
+	heap  expiryHeap
+	items map[string]*expiryItem
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{items: make(map[string]*expiryItem)}
+}
+
+// set indexes the key with the given deadline, replacing any it had before.
+func (x *expiryIndex) set(key string, deadline time.Time) {
+	item, exists := x.items[key]
+	if exists {
+		item.deadline = deadline
+		heap.Fix(&x.heap, item.index)
+		return
+	}
+	item = &expiryItem{key: key, deadline: deadline}
+	heap.Push(&x.heap, item)
+	x.items[key] = item
+}
+
+// remove drops the key from the index, if it's there.
+func (x *expiryIndex) remove(key string) {
+	item, exists := x.items[key]
+	if exists {
+		heap.Remove(&x.heap, item.index)
+		delete(x.items, key)
+	}
+}
+
+// expired removes every key whose deadline is before now from the index and
+// calls fn for each, soonest first.
+func (x *expiryIndex) expired(now time.Time, fn func(key string)) {
+	for len(x.heap) > 0 && now.After(x.heap[0].deadline) {
+		item := heap.Pop(&x.heap).(*expiryItem)
+		delete(x.items, item.key)
+		fn(item.key)
+	}
+}
+
+func (x *expiryIndex) len() int {
+	return len(x.heap)
+}
+
+// reset empties the index.
+func (x *expiryIndex) reset() {
+	x.heap = nil
+	x.items = make(map[string]*expiryItem)
+}
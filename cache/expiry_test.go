@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiryIndex(t *testing.T) {
+	assert := assert.New(t)
+	index := newExpiryIndex()
+	now := time.Now()
+
+	index.set("a", now.Add(3*time.Second))
+	index.set("b", now.Add(1*time.Second))
+	index.set("c", now.Add(2*time.Second))
+	index.set("d", now.Add(4*time.Second))
+
+	// Rewriting a key moves it rather than adding another item.
+	index.set("b", now.Add(5*time.Second))
+	assert.Equal(4, index.len())
+
+	index.remove("d")
+	index.remove("missing")
+	assert.Equal(3, index.len())
+
+	var expired []string
+	index.expired(now.Add(3500*time.Millisecond), func(key string) {
+		expired = append(expired, key)
+	})
+	assert.Equal([]string{"c", "a"}, expired)
+	assert.Equal(1, index.len())
+
+	index.reset()
+	assert.Equal(0, index.len())
+}
@@ -0,0 +1,304 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/eastside-eng/redis-proxy/log"
+)
+
+// lfuElement is a container type used by DecayingLFUCache.
+type lfuElement struct {
+	Key       string
+	Val       interface{}
+	Timestamp time.Time
+	Expiry    time.Time
+	// The estimated memory used by the entry, see entrySize.
+	size int64
+
+	refresh refreshState
+
+	// The frequency bucket the element is in, and its place in the bucket.
+	bucket *list.Element
+	entry  *list.Element
+}
+
+// lfuBucket holds the elements that have been used the same number of times,
+// most recently used first.
+type lfuBucket struct {
+	frequency int
+	elements  *list.List
+}
+
+// DecayingLFUCache is a LFU cache that expires elements in the same way as
+// DecayingLRUCache. When over capacity it evicts the least frequently used
+// element, breaking ties by recency.
+//
+// Elements are kept in buckets of equal frequency, with the buckets in
+// ascending order of frequency, so that using or evicting an element is
+// constant time.
+type DecayingLFUCache struct {
+	// Accessed atomically, kept first for 64 bit alignment.
+	hits   uint64
+	misses uint64
+
+	buckets *list.List
+	hashmap map[string]*lfuElement
+	lock    sync.Mutex
+
+	// The entry count and byte limits, either of which may be zero for no
+	// limit, and the bytes currently used.
+	capacity  int
+	maxMemory int64
+	bytes     int64
+
+	decay
+}
+
+var _ Cache = (*DecayingLFUCache)(nil)
+
+// NewDecayingLFUCache returns a new DecayingLFUCache with the given capacity,
+// period and ttl. A capacity of zero leaves the number of entries unbounded.
+func NewDecayingLFUCache(capacity int, period time.Duration, ttl time.Duration) (*DecayingLFUCache, error) {
+	if period < 0 {
+		return nil, errors.New("Period must be non-negative")
+	}
+
+	if ttl < 0 {
+		return nil, errors.New("Expiry TTL must be non-negative")
+	}
+
+	cache := &DecayingLFUCache{
+		buckets:  list.New(),
+		hashmap:  make(map[string]*lfuElement),
+		capacity: capacity,
+		lock:     sync.Mutex{},
+
+		// For the redeemer
+		decay: newDecay(period, ttl),
+	}
+	return cache, nil
+}
+
+// Get returns the value of the key in the cache, iff it exists, and a boolean
+// for checking existence. If a key has no entry, nil will be returned.
+func (cache *DecayingLFUCache) Get(key string) (interface{}, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := time.Now()
+	element, exists := cache.hashmap[key]
+	if exists && now.Before(element.Expiry) {
+		atomic.AddUint64(&cache.hits, 1)
+		cache.touch(element)
+		cache.revalidate(key, element.Timestamp, now, &element.refresh)
+		return element.Val, exists
+	}
+	atomic.AddUint64(&cache.misses, 1)
+	return nil, false
+}
+
+// GetStale returns the value of the key even if it has expired, as long as it
+// is within the grace window. It doesn't count as a use of the key.
+func (cache *DecayingLFUCache) GetStale(key string) (interface{}, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, exists := cache.hashmap[key]
+	if exists && !cache.removable(element.Expiry, time.Now()) {
+		return element.Val, true
+	}
+	return nil, false
+}
+
+// Add atomicly inserts the key and value into the cache. Replacing the value
+// of a key counts as a use of it. The entry expires after the given ttl, or
+// the cache's TTL if that is shorter or ttl is zero.
+func (cache *DecayingLFUCache) Add(key string, val interface{}, ttl time.Duration) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := time.Now()
+	size := entrySize(key, val)
+	element, exists := cache.hashmap[key]
+	if cache.maxMemory > 0 && size > cache.maxMemory {
+		// Too big to cache at all. Any older value must still go.
+		Logger.Infow("Not caching key larger than max memory.", "key", key, "bytes", size)
+		if exists {
+			cache.remove(element)
+		}
+		return
+	}
+
+	expiry := cache.deadline(now, ttl)
+	Logger.Infow("Adding key.", "key", key, "expiry", expiry)
+	// Index the new deadline, replacing the old one if any.
+	cache.schedule(key, expiry)
+
+	if exists {
+		cache.bytes += size - element.size
+		element.Val = val
+		element.Timestamp = now
+		element.Expiry = expiry
+		element.size = size
+		element.refresh = refreshState{}
+		cache.touch(element)
+	} else {
+		element = &lfuElement{Key: key, Val: val, Timestamp: now, Expiry: expiry, size: size}
+		front := cache.buckets.Front()
+		if front == nil || front.Value.(*lfuBucket).frequency != 1 {
+			front = cache.buckets.PushFront(&lfuBucket{1, list.New()})
+		}
+		element.bucket = front
+		element.entry = front.Value.(*lfuBucket).elements.PushFront(element)
+		cache.hashmap[key] = element
+		cache.bytes += size
+	}
+
+	// Handle eviction. The element just added would usually be the least
+	// frequently used, so it is spared.
+	for cache.overLimit() {
+		lfu := cache.leastFrequent(element)
+		Logger.Infow("Evicting key due to capacity.",
+			"key", lfu.Key,
+			"size", len(cache.hashmap),
+			"bytes", cache.bytes)
+		cache.remove(lfu)
+	}
+}
+
+// overLimit reports whether the cache holds more entries, or bytes, than
+// allowed.
+func (cache *DecayingLFUCache) overLimit() bool {
+	return (cache.capacity > 0 && len(cache.hashmap) > cache.capacity) ||
+		(cache.maxMemory > 0 && cache.bytes > cache.maxMemory)
+}
+
+// touch moves the element into the bucket for one more use.
+func (cache *DecayingLFUCache) touch(element *lfuElement) {
+	current := element.bucket
+	frequency := current.Value.(*lfuBucket).frequency + 1
+	next := current.Next()
+	if next == nil || next.Value.(*lfuBucket).frequency != frequency {
+		next = cache.buckets.InsertAfter(&lfuBucket{frequency, list.New()}, current)
+	}
+	cache.unlink(element)
+	element.bucket = next
+	element.entry = next.Value.(*lfuBucket).elements.PushFront(element)
+}
+
+// leastFrequent returns the element to evict other than spare, or nil if there
+// is none.
+func (cache *DecayingLFUCache) leastFrequent(spare *lfuElement) *lfuElement {
+	for bucket := cache.buckets.Front(); bucket != nil; bucket = bucket.Next() {
+		for entry := bucket.Value.(*lfuBucket).elements.Back(); entry != nil; entry = entry.Prev() {
+			if entry.Value != spare {
+				return entry.Value.(*lfuElement)
+			}
+		}
+	}
+	return nil
+}
+
+// unlink takes the element out of its bucket, dropping the bucket if it's left
+// empty.
+func (cache *DecayingLFUCache) unlink(element *lfuElement) {
+	bucket := element.bucket.Value.(*lfuBucket)
+	bucket.elements.Remove(element.entry)
+	if bucket.elements.Len() == 0 {
+		cache.buckets.Remove(element.bucket)
+	}
+}
+
+func (cache *DecayingLFUCache) remove(element *lfuElement) {
+	cache.bytes -= element.size
+	cache.unlink(element)
+	delete(cache.hashmap, element.Key)
+	cache.unschedule(element.Key)
+}
+
+// Remove atomicly removes the given key from the cache.
+func (cache *DecayingLFUCache) Remove(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, exists := cache.hashmap[key]
+	if exists {
+		Logger.Infow("Removing key.", "key", key)
+		cache.remove(element)
+	}
+}
+
+// RemoveIfAfter will atomicly remove the given key from the cache, iff its
+// entry and grace window expired before the given time.
+func (cache *DecayingLFUCache) RemoveIfAfter(key string, after time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.removeIfAfter(key, after)
+}
+
+func (cache *DecayingLFUCache) removeIfAfter(key string, after time.Time) {
+	element, exists := cache.hashmap[key]
+	if exists && cache.removable(element.Expiry, after) {
+		Logger.Infow("Evicting key due to expiry.",
+			"key", key,
+			"expiry", element.Expiry)
+		cache.remove(element)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (cache *DecayingLFUCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return len(cache.hashmap)
+}
+
+// Stats returns the cache's hit and miss counts and its current size.
+func (cache *DecayingLFUCache) Stats() Stats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return Stats{
+		Hits:   atomic.LoadUint64(&cache.hits),
+		Misses: atomic.LoadUint64(&cache.misses),
+		Len:    len(cache.hashmap),
+		Bytes:  cache.bytes,
+	}
+}
+
+// Flush atomicly removes every entry from the cache.
+func (cache *DecayingLFUCache) Flush() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	Logger.Infow("Flushing cache.", "size", len(cache.hashmap))
+	cache.buckets.Init()
+	cache.index.reset()
+	cache.hashmap = make(map[string]*lfuElement)
+	cache.bytes = 0
+}
+
+func (cache *DecayingLFUCache) expire(now time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.decay.expire(now, cache.removeIfAfter)
+}
+
+// Start will start the Redeemer coroutine. The callee must call #Stop() to
+// allow GC to clean up the cache.
+func (cache *DecayingLFUCache) Start() {
+	Logger.Infow("Redeemer routine started.")
+	go cache.redeemer(cache.expire)
+}
+
+// Stop will kill the Redeemer coroutine and allow GC to happen.
+func (cache *DecayingLFUCache) Stop() {
+	cache.stop()
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLFUConstructor(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLFUCache(2, time.Second, -1)
+
+	assert.Nil(cache)
+	assert.NotNil(err)
+}
+
+func TestLFUEvictsLeastFrequent(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLFUCache(2, time.Second, time.Minute)
+	assert.Nil(err)
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+
+	// 1 is used more often than 2, so 2 is evicted even though it was used
+	// more recently.
+	cache.Get("1")
+	cache.Get("1")
+	cache.Get("2")
+	cache.Add("3", "test3", 0)
+
+	res, exists := cache.Get("1")
+	assert.Equal("test1", res)
+	assert.True(exists)
+
+	_, exists = cache.Get("2")
+	assert.False(exists)
+
+	res, exists = cache.Get("3")
+	assert.Equal("test3", res)
+	assert.True(exists)
+	assert.Equal(2, cache.Len())
+}
+
+func TestLFUTiesEvictLeastRecent(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLFUCache(2, time.Second, time.Minute)
+	assert.Nil(err)
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+	cache.Add("3", "test3", 0)
+
+	_, exists := cache.Get("1")
+	assert.False(exists)
+
+	_, exists = cache.Get("2")
+	assert.True(exists)
+}
+
+func TestLFURemoveAndFlush(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLFUCache(4, time.Second, time.Minute)
+	assert.Nil(err)
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+	cache.Get("2")
+	cache.Remove("2")
+
+	_, exists := cache.Get("2")
+	assert.False(exists)
+	assert.Equal(1, cache.Len())
+
+	cache.Flush()
+	_, exists = cache.Get("1")
+	assert.False(exists)
+	assert.Equal(0, cache.Len())
+
+	stats := cache.Stats()
+	assert.Equal(uint64(1), stats.Hits)
+	assert.Equal(uint64(2), stats.Misses)
+}
+
+func TestLFUTTL(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLFUCache(2, 50*time.Microsecond, 100*time.Millisecond)
+	assert.Nil(err)
+
+	cache.Start()
+	defer cache.Stop()
+
+	cache.Add("1", "test1", 0)
+	time.Sleep(200 * time.Millisecond)
+
+	_, exists := cache.Get("1")
+	assert.False(exists)
+	assert.Equal(0, cache.Len())
+}
+
+func TestLFUMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLFUCache(0, time.Second, time.Minute)
+	assert.Nil(err)
+	cache.maxMemory = 2 * entrySize("1", "test1")
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+	cache.Get("1")
+
+	// 2 is evicted to make room, rather than the more used 1 or the new 3.
+	cache.Add("3", "test3", 0)
+	_, exists := cache.Get("2")
+	assert.False(exists)
+	_, exists = cache.Get("3")
+	assert.True(exists)
+	assert.Equal(2*entrySize("1", "test1"), cache.Stats().Bytes)
+
+	cache.Flush()
+	assert.Equal(int64(0), cache.Stats().Bytes)
+}
+
+func TestLFUIndexBounded(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLFUCache(2, time.Second, time.Minute)
+	assert.Nil(err)
+
+	for i := 0; i < 1000; i++ {
+		cache.Add("1", "test1", 0)
+		cache.Add(strconv.Itoa(i), "test", 0)
+	}
+	assert.Equal(2, cache.index.len())
+
+	cache.Remove("1")
+	assert.Equal(1, cache.index.len())
+}
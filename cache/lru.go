@@ -4,46 +4,56 @@ import (
 	"container/list"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/eastside-eng/redis-proxy/log"
 )
 
-type Cache interface {
-}
-
 // cacheElement is a container type used by DecayingLRUCache.
 type cacheElement struct {
 	Key       string
 	Val       interface{}
 	Timestamp time.Time
+	Expiry    time.Time
+	// The estimated memory used by the entry, see entrySize.
+	size int64
+
+	refresh refreshState
 }
 
 // DecayingLRUCache is a LRU cache that also uses wall-clock time to expire
 // elements based on a configurable TTL. To enable this functionality, the cache
-// uses ~2x memory per key (note that's not per entry) as a typical LRU cache.
+// keeps a second, per-entry structure alongside a typical LRU cache.
 //
 // The time-based expiry is driven by a periodic coroutine that checks in
-// constant time if an element is expired. It keeps a time-ordered queue of
-// elements and simply iterates from the front until it hits an element that has
-// a valid TTL. The periodicity of the eviction routine is parameterized and
-// given to the constructor.
+// constant time if an element is expired. It keeps a min-heap of the elements'
+// deadlines and pops from it until it hits an element that has a valid TTL.
+// The heap is updated whenever an element is added, replaced or removed, so it
+// never holds more than one item per element. The periodicity of the eviction
+// routine is parameterized and given to the constructor.
 type DecayingLRUCache struct {
-	Cache
+	// Accessed atomically, kept first for 64 bit alignment.
+	hits   uint64
+	misses uint64
 
 	elements *list.List
-	log      *list.List
 	hashmap  map[string]*list.Element
-	capacity int
 	lock     sync.Mutex
 
-	ticker     *time.Ticker
-	stopTicker chan bool
-	ttl        time.Duration
+	// The entry count and byte limits, either of which may be zero for no
+	// limit, and the bytes currently used.
+	capacity  int
+	maxMemory int64
+	bytes     int64
+
+	decay
 }
 
+var _ Cache = (*DecayingLRUCache)(nil)
+
 // NewDecayingLRUCache returns a new DecayingLRUCache with the given capacity,
-// period and ttl.
+// period and ttl. A capacity of zero leaves the number of entries unbounded.
 func NewDecayingLRUCache(capacity int, period time.Duration, ttl time.Duration) (*DecayingLRUCache, error) {
 	if period < 0 {
 		return nil, errors.New("Period must be non-negative")
@@ -55,15 +65,12 @@ func NewDecayingLRUCache(capacity int, period time.Duration, ttl time.Duration)
 
 	cache := &DecayingLRUCache{
 		elements: list.New(),
-		log:      list.New(),
 		hashmap:  make(map[string]*list.Element),
 		capacity: capacity,
 		lock:     sync.Mutex{},
 
 		// For the redeemer
-		ticker:     time.NewTicker(period),
-		stopTicker: make(chan bool),
-		ttl:        ttl,
+		decay: newDecay(period, ttl),
 	}
 	return cache, nil
 }
@@ -71,49 +78,98 @@ func NewDecayingLRUCache(capacity int, period time.Duration, ttl time.Duration)
 // Get returns the value of the key in the cache, iff it exists, and a boolean
 // for checking existence. If a key has no entry, nil will be returned.
 func (cache *DecayingLRUCache) Get(key string) (interface{}, bool) {
+	// Even reads reorder the list, so they need the lock too.
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := time.Now()
 	ref, exists := cache.hashmap[key]
-	if exists {
+	if exists && now.Before(ref.Value.(*cacheElement).Expiry) {
+		element := ref.Value.(*cacheElement)
+		atomic.AddUint64(&cache.hits, 1)
 		cache.elements.MoveToFront(ref)
-		return ref.Value.(*cacheElement).Val, exists
+		cache.revalidate(key, element.Timestamp, now, &element.refresh)
+		return element.Val, exists
 	}
-	return nil, exists
+	atomic.AddUint64(&cache.misses, 1)
+	return nil, false
+}
+
+// GetStale returns the value of the key even if it has expired, as long as it
+// is within the grace window. It doesn't count as a use of the key.
+func (cache *DecayingLRUCache) GetStale(key string) (interface{}, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	ref, exists := cache.hashmap[key]
+	if exists && !cache.removable(ref.Value.(*cacheElement).Expiry, time.Now()) {
+		return ref.Value.(*cacheElement).Val, true
+	}
+	return nil, false
 }
 
 // Add atomicly inserts the key and value into the cache, updating it's value,
-// recency and timestamp.
-func (cache *DecayingLRUCache) Add(key string, val interface{}) {
+// recency and timestamp. The entry expires after the given ttl, or the cache's
+// TTL if that is shorter or ttl is zero.
+func (cache *DecayingLRUCache) Add(key string, val interface{}, ttl time.Duration) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
-	element := &cacheElement{key, val, time.Now()}
-	Logger.Infow("Adding key.", "key", key)
-	// Append to our time-ordered log
-	cache.log.PushBack(element)
+	now := time.Now()
+	size := entrySize(key, val)
+	ref, exists := cache.hashmap[key]
+	if cache.maxMemory > 0 && size > cache.maxMemory {
+		// Too big to cache at all. Any older value must still go.
+		Logger.Infow("Not caching key larger than max memory.", "key", key, "bytes", size)
+		if exists {
+			cache.remove(ref)
+		}
+		return
+	}
+
+	element := &cacheElement{Key: key, Val: val, Timestamp: now, Expiry: cache.deadline(now, ttl), size: size}
+	Logger.Infow("Adding key.", "key", key, "expiry", element.Expiry)
+	// Index the new deadline, replacing the old one if any.
+	cache.schedule(key, element.Expiry)
 
 	// Update both the hashmap and doubly linked list for the element.
-	ref, exists := cache.hashmap[key]
 	if exists {
 		cache.elements.MoveToFront(ref)
+		cache.bytes -= ref.Value.(*cacheElement).size
 		ref.Value = element
 	} else {
 		listElement := cache.elements.PushFront(element)
 		cache.hashmap[key] = listElement
 	}
+	cache.bytes += size
 
-	// Handle eviction. Could be more DRY.
-	if cache.elements.Len() > cache.capacity {
+	// Handle eviction. The new element is at the front, and fits on its own,
+	// so it's never evicted.
+	for cache.overLimit() {
 		lru := cache.elements.Back()
-		if lru != nil {
-			lruKey := lru.Value.(*cacheElement).Key
-			Logger.Infow("Evicting key due to capacity.",
-				"key", lruKey,
-				"size", cache.elements.Len())
-			cache.elements.Remove(lru)
-			delete(cache.hashmap, lruKey)
-		}
+		Logger.Infow("Evicting key due to capacity.",
+			"key", lru.Value.(*cacheElement).Key,
+			"size", cache.elements.Len(),
+			"bytes", cache.bytes)
+		cache.remove(lru)
 	}
 }
 
+// overLimit reports whether the cache holds more entries, or bytes, than
+// allowed.
+func (cache *DecayingLRUCache) overLimit() bool {
+	return (cache.capacity > 0 && cache.elements.Len() > cache.capacity) ||
+		(cache.maxMemory > 0 && cache.bytes > cache.maxMemory)
+}
+
+func (cache *DecayingLRUCache) remove(ref *list.Element) {
+	element := ref.Value.(*cacheElement)
+	cache.bytes -= element.size
+	cache.elements.Remove(ref)
+	delete(cache.hashmap, element.Key)
+	cache.unschedule(element.Key)
+}
+
 // Remove atomicly removes the given key from the cache.
 func (cache *DecayingLRUCache) Remove(key string) {
 	cache.lock.Lock()
@@ -122,77 +178,81 @@ func (cache *DecayingLRUCache) Remove(key string) {
 	ref, exists := cache.hashmap[key]
 	if exists {
 		Logger.Infow("Removing key.", "key", key)
-		cache.elements.Remove(ref)
-		delete(cache.hashmap, key)
+		cache.remove(ref)
 	}
 }
 
-// RemoveIfAfter will atomicly remove the given key from the cache, iff the most recent
-// timestamp + TTL is after the given time.
+// RemoveIfAfter will atomicly remove the given key from the cache, iff its
+// entry and grace window expired before the given time.
 func (cache *DecayingLRUCache) RemoveIfAfter(key string, after time.Time) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
+	cache.removeIfAfter(key, after)
+}
+
+func (cache *DecayingLRUCache) removeIfAfter(key string, after time.Time) {
 	ref, exists := cache.hashmap[key]
 	if exists {
-		element := ref.Value.(*cacheElement)
-		expiry := element.Timestamp.Add(cache.ttl)
-		expired := after.After(expiry)
-		if expired {
+		expiry := ref.Value.(*cacheElement).Expiry
+		if cache.removable(expiry, after) {
 			Logger.Infow("Evicting key due to expiry.",
 				"key", key,
 				"expiry", expiry)
-			cache.elements.Remove(ref)
-			delete(cache.hashmap, key)
+			cache.remove(ref)
 		}
 	}
 }
 
-func (cache *DecayingLRUCache) redeemer() {
-	for {
-		select {
-		case <-cache.ticker.C:
-			cursor := cache.log.Front()
-			now := time.Now()
-			// Logger.Infow("Redeemer routine running.", "now", now)
-			for cursor != nil {
-				element := cursor.Value.(*cacheElement)
-				expiry := element.Timestamp.Add(cache.ttl)
-				expired := now.After(expiry)
-
-				// Because the log is ordered by time, we can bail out once we hit a
-				// non-expired entry.
-				if !expired {
-					break
-				}
-				// Because the TS is set on creation and not mutable, we don't need to
-				// lock when reading TS above and can simply lock when removing from
-				// the underly data structures.
-
-				// One issue is that the log will contain multiple entries for a key,
-				// we need to lock and check the map for the _real_ TS.
-				cache.RemoveIfAfter(element.Key, now)
-
-				// Move cursor and remove last element.
-				prev := cursor
-				cursor = cursor.Next()
-				cache.log.Remove(prev)
-			}
-		case <-cache.stopTicker:
-			cache.ticker.Stop()
-			return
-		}
+// Len returns the number of entries in the cache.
+func (cache *DecayingLRUCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.elements.Len()
+}
+
+// Stats returns the cache's hit and miss counts and its current size. Every
+// key looked up counts once, so a lookup of several keys counts several times.
+func (cache *DecayingLRUCache) Stats() Stats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return Stats{
+		Hits:   atomic.LoadUint64(&cache.hits),
+		Misses: atomic.LoadUint64(&cache.misses),
+		Len:    cache.elements.Len(),
+		Bytes:  cache.bytes,
 	}
 }
 
+// Flush atomicly removes every entry from the cache.
+func (cache *DecayingLRUCache) Flush() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	Logger.Infow("Flushing cache.", "size", cache.elements.Len())
+	cache.elements.Init()
+	cache.index.reset()
+	cache.hashmap = make(map[string]*list.Element)
+	cache.bytes = 0
+}
+
+func (cache *DecayingLRUCache) expire(now time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.decay.expire(now, cache.removeIfAfter)
+}
+
 // Start will start the Redeemer coroutine. The callee must call #Stop() to
 // allow GC to clean up the cache.
 func (cache *DecayingLRUCache) Start() {
 	Logger.Infow("Redeemer routine started.")
-	go cache.redeemer()
+	go cache.redeemer(cache.expire)
 }
 
 // Stop will kill the Redeemer coroutine and allow GC to happen.
 func (cache *DecayingLRUCache) Stop() {
-	cache.stopTicker <- true
+	cache.stop()
 }
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,8 +35,8 @@ func TestCacheSimple(t *testing.T) {
 	cache.Start()
 	defer cache.Stop()
 
-	cache.Add("1", "test1")
-	cache.Add("2", "test2")
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
 
 	res, exists := cache.Get("1")
 	assert.Equal("test1", res)
@@ -66,8 +68,8 @@ func TestCacheLRU(t *testing.T) {
 	cache.Start()
 	defer cache.Stop()
 
-	cache.Add("1", "test1")
-	cache.Add("2", "test2")
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
 
 	res, exists := cache.Get("1")
 	assert.Equal("test1", res)
@@ -82,7 +84,7 @@ func TestCacheLRU(t *testing.T) {
 	assert.False(exists)
 
 	// Testing that 1 is evicted as the LRU goes over capacity.
-	cache.Add("3", "test3")
+	cache.Add("3", "test3", 0)
 
 	res, exists = cache.Get("1")
 	assert.Nil(res)
@@ -98,7 +100,7 @@ func TestCacheLRU(t *testing.T) {
 
 	// Testing that LRU correctly updates 2 and evicts 3.
 	cache.Get("2")
-	cache.Add("1", "test1")
+	cache.Add("1", "test1", 0)
 
 	res, exists = cache.Get("1")
 	assert.Equal("test1", res)
@@ -124,8 +126,8 @@ func TestCacheTTL(t *testing.T) {
 	cache.Start()
 	defer cache.Stop()
 
-	cache.Add("1", "test1")
-	cache.Add("2", "test2")
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
 
 	res, exists := cache.Get("1")
 	assert.Equal("test1", res)
@@ -161,9 +163,118 @@ func TestCacheTTLCorrectness(t *testing.T) {
 	defer cache.Stop()
 
 	for i := 0; i < 1000; i++ {
-		cache.Add("1", "test1")
+		cache.Add("1", "test1", 0)
 		res, exists := cache.Get("1")
 		assert.Equal("test1", res)
 		assert.True(exists)
 	}
 }
+
+func TestCacheStats(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLRUCache(2, time.Second, time.Minute)
+	assert.Nil(err)
+
+	cache.Add("1", "test1", 0)
+	cache.Get("1")
+	cache.Get("1")
+	cache.Get("2")
+
+	stats := cache.Stats()
+	assert.Equal(uint64(2), stats.Hits)
+	assert.Equal(uint64(1), stats.Misses)
+	assert.Equal(1, stats.Len)
+}
+
+func TestCacheEntryTTL(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLRUCache(2, time.Second, time.Minute)
+	assert.Nil(err)
+
+	cache.Add("1", "test1", 50*time.Millisecond)
+	cache.Add("2", "test2", time.Hour)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The entry TTL applies when shorter than the cache's TTL.
+	_, exists := cache.Get("1")
+	assert.False(exists)
+
+	_, exists = cache.Get("2")
+	assert.True(exists)
+}
+
+func TestCacheMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLRUCache(0, time.Second, time.Minute)
+	assert.Nil(err)
+	cache.maxMemory = 2 * entrySize("1", "test1")
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+	assert.Equal(2*entrySize("1", "test1"), cache.Stats().Bytes)
+
+	// A larger value for 2 pushes out 1, the least recently used.
+	cache.Add("2", "test2-longer", 0)
+	_, exists := cache.Get("1")
+	assert.False(exists)
+	assert.Equal(entrySize("2", "test2-longer"), cache.Stats().Bytes)
+
+	// Values that could never fit aren't cached, and drop the old value.
+	cache.Add("2", strings.Repeat("x", int(cache.maxMemory)), 0)
+	_, exists = cache.Get("2")
+	assert.False(exists)
+	assert.Equal(int64(0), cache.Stats().Bytes)
+
+	cache.Add("1", "test1", 0)
+	cache.Remove("1")
+	assert.Equal(int64(0), cache.Stats().Bytes)
+}
+
+func TestCacheUnboundedCapacity(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLRUCache(0, time.Second, time.Minute)
+	assert.Nil(err)
+
+	for i := 0; i < 100; i++ {
+		cache.Add(strconv.Itoa(i), "test", 0)
+	}
+	assert.Equal(100, cache.Len())
+}
+
+// Entries with a short TTL are expired by the redeemer, not just on lookup,
+// even when written after entries with the cache's longer TTL.
+func TestCacheRedeemsEntryTTL(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLRUCache(4, 50*time.Microsecond, time.Minute)
+	assert.Nil(err)
+
+	cache.Start()
+	defer cache.Stop()
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(1, cache.Len())
+}
+
+// The expiration index holds one item per entry, however often the entries are
+// rewritten, removed or evicted.
+func TestCacheIndexBounded(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewDecayingLRUCache(2, time.Second, time.Minute)
+	assert.Nil(err)
+
+	for i := 0; i < 1000; i++ {
+		cache.Add("1", "test1", 0)
+		cache.Add(strconv.Itoa(i), "test", 0)
+	}
+	assert.Equal(2, cache.index.len())
+
+	cache.Remove("1")
+	assert.Equal(1, cache.index.len())
+
+	cache.Flush()
+	assert.Equal(0, cache.index.len())
+}
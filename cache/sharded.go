@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// ShardedCache spreads keys over a number of independent caches, selected by
+// a hash of the key, so that concurrent connections rarely contend for the
+// same lock. Each shard has its own lock, limits and expiry routine.
+//
+// Limits, and eviction, are per shard: a ShardedCache of N shards with a
+// capacity of C evicts from a shard once it holds C/N entries, even if others
+// have room.
+type ShardedCache struct {
+	shards []Cache
+}
+
+var _ Cache = (*ShardedCache)(nil)
+
+// NewShardedCache returns a ShardedCache over the given shards. There must be
+// at least one.
+func NewShardedCache(shards []Cache) (*ShardedCache, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("A sharded cache needs at least one shard")
+	}
+	return &ShardedCache{shards: shards}, nil
+}
+
+// shard returns the shard holding the key.
+func (cache *ShardedCache) shard(key string) Cache {
+	return cache.shards[hashKey(key)%uint64(len(cache.shards))]
+}
+
+// Get returns the value of the key from its shard.
+func (cache *ShardedCache) Get(key string) (interface{}, bool) {
+	return cache.shard(key).Get(key)
+}
+
+// GetStale returns the value of the key, even if expired, from its shard.
+func (cache *ShardedCache) GetStale(key string) (interface{}, bool) {
+	return cache.shard(key).GetStale(key)
+}
+
+// Add inserts the key and value into the key's shard.
+func (cache *ShardedCache) Add(key string, val interface{}, ttl time.Duration) {
+	cache.shard(key).Add(key, val, ttl)
+}
+
+// Remove removes the key from its shard.
+func (cache *ShardedCache) Remove(key string) {
+	cache.shard(key).Remove(key)
+}
+
+// Len returns the number of entries across all shards.
+func (cache *ShardedCache) Len() int {
+	n := 0
+	for _, shard := range cache.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+// Stats returns the sum of the shards' stats. The shards are read one at a
+// time, so the result isn't a consistent snapshot under concurrent use.
+func (cache *ShardedCache) Stats() Stats {
+	var stats Stats
+	for _, shard := range cache.shards {
+		s := shard.Stats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Len += s.Len
+		stats.Bytes += s.Bytes
+	}
+	return stats
+}
+
+// Flush removes every entry from every shard.
+func (cache *ShardedCache) Flush() {
+	for _, shard := range cache.shards {
+		shard.Flush()
+	}
+}
+
+// Start starts the expiry routine of every shard.
+func (cache *ShardedCache) Start() {
+	for _, shard := range cache.shards {
+		shard.Start()
+	}
+}
+
+// Stop stops the expiry routine of every shard.
+func (cache *ShardedCache) Stop() {
+	for _, shard := range cache.shards {
+		shard.Stop()
+	}
+}
+
+// SetRefresher sets the refresher of every shard.
+func (cache *ShardedCache) SetRefresher(refresh func(key string)) {
+	for _, shard := range cache.shards {
+		shard.SetRefresher(refresh)
+	}
+}
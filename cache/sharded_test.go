@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/eastside-eng/redis-proxy/log"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestShardedConstructor(t *testing.T) {
+	cache, err := NewShardedCache(nil)
+	assert.Nil(t, cache)
+	assert.NotNil(t, err)
+}
+
+func TestShardedCache(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewCache(&Options{Capacity: 100, Period: time.Second, TTL: time.Minute, Shards: 4})
+	assert.Nil(err)
+	cache := c.(*ShardedCache)
+	assert.Equal(4, len(cache.shards))
+
+	for i := 0; i < 40; i++ {
+		cache.Add(strconv.Itoa(i), "test", 0)
+	}
+	for i := 0; i < 40; i++ {
+		res, exists := cache.Get(strconv.Itoa(i))
+		assert.True(exists)
+		assert.Equal("test", res)
+	}
+	cache.Get("missing")
+	cache.Remove("0")
+
+	// Every shard gets some of the keys.
+	for _, shard := range cache.shards {
+		assert.True(shard.Len() > 0)
+	}
+	assert.Equal(39, cache.Len())
+
+	stats := cache.Stats()
+	assert.Equal(uint64(40), stats.Hits)
+	assert.Equal(uint64(1), stats.Misses)
+	assert.Equal(39, stats.Len)
+
+	cache.Flush()
+	assert.Equal(0, cache.Len())
+}
+
+func TestShardedLimits(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewCache(&Options{Capacity: 10, MaxMemory: 1001, Period: time.Second, TTL: time.Minute, Shards: 4})
+	assert.Nil(err)
+	shard := c.(*ShardedCache).shards[0].(*DecayingLRUCache)
+	assert.Equal(3, shard.capacity)
+	assert.Equal(int64(251), shard.maxMemory)
+}
+
+// TestConcurrentAccess is meant to be run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	for _, engine := range []string{EngineLRU, EngineLFU} {
+		cache, err := NewCache(&Options{Engine: engine, Capacity: 64, Period: time.Millisecond, TTL: 10 * time.Millisecond, Shards: 4})
+		assert.Nil(t, err)
+		cache.Start()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					key := strconv.Itoa((g * i) % 100)
+					cache.Add(key, "test", 0)
+					cache.Get(key)
+					if i%10 == 0 {
+						cache.Remove(key)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		cache.Stop()
+		assert.True(t, cache.Len() <= 64, engine)
+	}
+}
+
+// BenchmarkShardedCache measures mixed read and write throughput against the
+// number of shards, e.g. go test -bench Sharded -cpu 1,8,32 ./cache
+func BenchmarkShardedCache(b *testing.B) {
+	// Logging every write would dominate the results.
+	defer log.SetLogger(log.Logger)
+	log.SetLogger(zap.NewNop().Sugar())
+
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache, err := NewCache(&Options{Capacity: 2048, Period: time.Second, TTL: time.Minute, Shards: shards})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					// Nine reads for every write.
+					if i%10 == 0 {
+						cache.Add(key, "value", 0)
+					} else {
+						cache.Get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
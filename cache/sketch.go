@@ -0,0 +1,88 @@
+package cache
+
+// sketchDepth is the number of rows, and so hash functions, in a sketch.
+const sketchDepth = 4
+
+// sketchMax is the most a counter can count to. Frequencies beyond it don't
+// change admission decisions and small counters age faster.
+const sketchMax = 15
+
+// countMinSketch estimates how often keys have been seen, in a fixed amount
+// of memory. Each key increments one counter per row and its estimate is the
+// smallest of those counters, which can only over-count due to collisions.
+//
+// To favour recent popularity, every counter is halved once sampleSize
+// increments have been made since the last halving.
+type countMinSketch struct {
+	rows       [sketchDepth][]uint8
+	mask       uint32
+	additions  int
+	sampleSize int
+}
+
+// newCountMinSketch returns a sketch sized for a cache of the given capacity.
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 16
+	for width < capacity {
+		width <<= 1
+	}
+	sketch := &countMinSketch{
+		mask:       uint32(width - 1),
+		sampleSize: 10 * capacity,
+	}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, width)
+	}
+	return sketch
+}
+
+// indexes returns the counter of the key in each row, using double hashing.
+// The key's hash is remixed first, because the cache shard was chosen with
+// the same hash and so its low bits are shared by every key in the shard.
+func (sketch *countMinSketch) indexes(key string) [sketchDepth]uint32 {
+	h := hashKey(key)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h1, h2 := uint32(h), uint32(h>>32)|1
+
+	var indexes [sketchDepth]uint32
+	for i := range indexes {
+		indexes[i] = (h1 + uint32(i)*h2) & sketch.mask
+	}
+	return indexes
+}
+
+// increment records a sighting of the key.
+func (sketch *countMinSketch) increment(key string) {
+	for row, i := range sketch.indexes(key) {
+		if sketch.rows[row][i] < sketchMax {
+			sketch.rows[row][i]++
+		}
+	}
+	sketch.additions++
+	if sketch.additions >= sketch.sampleSize {
+		sketch.age()
+	}
+}
+
+// estimate returns how often the key has been seen, recently.
+func (sketch *countMinSketch) estimate(key string) uint8 {
+	min := uint8(sketchMax)
+	for row, i := range sketch.indexes(key) {
+		if sketch.rows[row][i] < min {
+			min = sketch.rows[row][i]
+		}
+	}
+	return min
+}
+
+// age halves every counter.
+func (sketch *countMinSketch) age() {
+	for _, row := range sketch.rows {
+		for i := range row {
+			row[i] >>= 1
+		}
+	}
+	sketch.additions /= 2
+}
@@ -0,0 +1,364 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/eastside-eng/redis-proxy/log"
+)
+
+// The segments of a TinyLFUCache an element can be in.
+const (
+	segmentWindow = iota
+	segmentProbation
+	segmentProtected
+)
+
+// tinyElement is a container type used by TinyLFUCache.
+type tinyElement struct {
+	Key       string
+	Val       interface{}
+	Timestamp time.Time
+	Expiry    time.Time
+	// The estimated memory used by the entry, see entrySize.
+	size int64
+
+	refresh refreshState
+
+	// The segment the element is in, and its place in the segment's list.
+	segment int
+	ref     *list.Element
+}
+
+// TinyLFUCache is a W-TinyLFU cache: it only lets a new element into the
+// bulk of the cache if it is estimated to be used more often than the element
+// it would evict. This protects the working set from scans, which touch many
+// keys once each. Elements expire in the same way as DecayingLRUCache.
+//
+// New elements go into a small LRU window, about 1% of the capacity, so that
+// bursts of use can build up a frequency. Elements leaving the window are
+// candidates for the main cache, a segmented LRU of a probation segment and a
+// protected segment for elements used again while on probation. A candidate
+// is admitted if the main cache has room, or if a count-min sketch of recent
+// use rates it above probation's least recently used element, which is then
+// evicted in its place. Otherwise the candidate is dropped.
+type TinyLFUCache struct {
+	// Accessed atomically, kept first for 64 bit alignment.
+	hits   uint64
+	misses uint64
+
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	hashmap   map[string]*tinyElement
+	sketch    *countMinSketch
+	lock      sync.Mutex
+
+	// The entry count and byte limits, and the bytes currently used. The
+	// entry count is shared out between the segments.
+	capacity     int
+	windowCap    int
+	protectedCap int
+	maxMemory    int64
+	bytes        int64
+
+	decay
+}
+
+var _ Cache = (*TinyLFUCache)(nil)
+
+// NewTinyLFUCache returns a new TinyLFUCache with the given capacity, period
+// and ttl. Unlike the other engines it needs a capacity to size its segments.
+func NewTinyLFUCache(capacity int, period time.Duration, ttl time.Duration) (*TinyLFUCache, error) {
+	if capacity <= 0 {
+		return nil, errors.New("Capacity must be positive")
+	}
+
+	if period < 0 {
+		return nil, errors.New("Period must be non-negative")
+	}
+
+	if ttl < 0 {
+		return nil, errors.New("Expiry TTL must be non-negative")
+	}
+
+	windowCap := capacity / 100
+	if windowCap < 1 {
+		windowCap = 1
+	}
+	cache := &TinyLFUCache{
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		hashmap:      make(map[string]*tinyElement),
+		sketch:       newCountMinSketch(capacity),
+		lock:         sync.Mutex{},
+		capacity:     capacity,
+		windowCap:    windowCap,
+		protectedCap: (capacity - windowCap) * 8 / 10,
+
+		// For the redeemer
+		decay: newDecay(period, ttl),
+	}
+	return cache, nil
+}
+
+// segmentList returns the list of the given segment.
+func (cache *TinyLFUCache) segmentList(segment int) *list.List {
+	switch segment {
+	case segmentWindow:
+		return cache.window
+	case segmentProbation:
+		return cache.probation
+	}
+	return cache.protected
+}
+
+// Get returns the value of the key in the cache, iff it exists, and a boolean
+// for checking existence. If a key has no entry, nil will be returned. Misses
+// count towards the key's frequency too, so a key that keeps being asked for
+// will be admitted once it's added.
+func (cache *TinyLFUCache) Get(key string) (interface{}, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.sketch.increment(key)
+	now := time.Now()
+	element, exists := cache.hashmap[key]
+	if exists && now.Before(element.Expiry) {
+		atomic.AddUint64(&cache.hits, 1)
+		cache.touch(element)
+		cache.revalidate(key, element.Timestamp, now, &element.refresh)
+		return element.Val, exists
+	}
+	atomic.AddUint64(&cache.misses, 1)
+	return nil, false
+}
+
+// GetStale returns the value of the key even if it has expired, as long as it
+// is within the grace window. It doesn't count as a use of the key.
+func (cache *TinyLFUCache) GetStale(key string) (interface{}, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, exists := cache.hashmap[key]
+	if exists && !cache.removable(element.Expiry, time.Now()) {
+		return element.Val, true
+	}
+	return nil, false
+}
+
+// touch records a use of the element, promoting it to the protected segment
+// if it was on probation.
+func (cache *TinyLFUCache) touch(element *tinyElement) {
+	if element.segment != segmentProbation {
+		cache.segmentList(element.segment).MoveToFront(element.ref)
+		return
+	}
+
+	cache.probation.Remove(element.ref)
+	element.segment = segmentProtected
+	element.ref = cache.protected.PushFront(element)
+
+	// Make room by demoting the protected segment's LRU back to probation.
+	if cache.protected.Len() > cache.protectedCap {
+		demoted := cache.protected.Remove(cache.protected.Back()).(*tinyElement)
+		demoted.segment = segmentProbation
+		demoted.ref = cache.probation.PushFront(demoted)
+	}
+}
+
+// Add atomicly inserts the key and value into the cache. A new key starts in
+// the window, replacing a key's value counts as a use of it. The entry expires
+// after the given ttl, or the cache's TTL if that is shorter or ttl is zero.
+func (cache *TinyLFUCache) Add(key string, val interface{}, ttl time.Duration) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := time.Now()
+	size := entrySize(key, val)
+	element, exists := cache.hashmap[key]
+	if cache.maxMemory > 0 && size > cache.maxMemory {
+		// Too big to cache at all. Any older value must still go.
+		Logger.Infow("Not caching key larger than max memory.", "key", key, "bytes", size)
+		if exists {
+			cache.remove(element)
+		}
+		return
+	}
+
+	cache.sketch.increment(key)
+	expiry := cache.deadline(now, ttl)
+	Logger.Infow("Adding key.", "key", key, "expiry", expiry)
+	// Index the new deadline, replacing the old one if any.
+	cache.schedule(key, expiry)
+
+	if exists {
+		cache.bytes += size - element.size
+		element.Val = val
+		element.Timestamp = now
+		element.Expiry = expiry
+		element.size = size
+		element.refresh = refreshState{}
+		cache.touch(element)
+	} else {
+		element = &tinyElement{Key: key, Val: val, Timestamp: now, Expiry: expiry, size: size}
+		element.segment = segmentWindow
+		element.ref = cache.window.PushFront(element)
+		cache.hashmap[key] = element
+		cache.bytes += size
+
+		if cache.window.Len() > cache.windowCap {
+			candidate := cache.window.Back().Value.(*tinyElement)
+			cache.admit(candidate)
+		}
+	}
+
+	// The entry count is kept by admit, but a larger value, or one admitted
+	// into a main cache with room, can take the cache over its byte limit.
+	for cache.maxMemory > 0 && cache.bytes > cache.maxMemory {
+		victim := cache.victim(element)
+		Logger.Infow("Evicting key due to capacity.",
+			"key", victim.Key,
+			"size", len(cache.hashmap),
+			"bytes", cache.bytes)
+		cache.remove(victim)
+	}
+}
+
+// admit moves the candidate from the window into probation, if the main
+// cache has room or the candidate beats the element it would evict, and
+// drops it otherwise.
+func (cache *TinyLFUCache) admit(candidate *tinyElement) {
+	if cache.probation.Len()+cache.protected.Len() >= cache.capacity-cache.windowCap {
+		victim := cache.probation.Back()
+		if victim == nil {
+			victim = cache.protected.Back()
+		}
+		if victim == nil || cache.sketch.estimate(candidate.Key) <= cache.sketch.estimate(victim.Value.(*tinyElement).Key) {
+			Logger.Infow("Evicting key due to capacity.",
+				"key", candidate.Key,
+				"size", len(cache.hashmap))
+			cache.remove(candidate)
+			return
+		}
+		evicted := victim.Value.(*tinyElement)
+		Logger.Infow("Evicting key due to capacity.",
+			"key", evicted.Key,
+			"size", len(cache.hashmap))
+		cache.remove(evicted)
+	}
+
+	cache.window.Remove(candidate.ref)
+	candidate.segment = segmentProbation
+	candidate.ref = cache.probation.PushFront(candidate)
+}
+
+// victim returns the element to evict to free memory, other than spare,
+// trying probation first, then the window and protected segments.
+func (cache *TinyLFUCache) victim(spare *tinyElement) *tinyElement {
+	for _, l := range []*list.List{cache.probation, cache.window, cache.protected} {
+		for ref := l.Back(); ref != nil; ref = ref.Prev() {
+			if ref.Value != spare {
+				return ref.Value.(*tinyElement)
+			}
+		}
+	}
+	return nil
+}
+
+func (cache *TinyLFUCache) remove(element *tinyElement) {
+	cache.bytes -= element.size
+	cache.segmentList(element.segment).Remove(element.ref)
+	delete(cache.hashmap, element.Key)
+	cache.unschedule(element.Key)
+}
+
+// Remove atomicly removes the given key from the cache.
+func (cache *TinyLFUCache) Remove(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, exists := cache.hashmap[key]
+	if exists {
+		Logger.Infow("Removing key.", "key", key)
+		cache.remove(element)
+	}
+}
+
+// RemoveIfAfter will atomicly remove the given key from the cache, iff its
+// entry and grace window expired before the given time.
+func (cache *TinyLFUCache) RemoveIfAfter(key string, after time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.removeIfAfter(key, after)
+}
+
+func (cache *TinyLFUCache) removeIfAfter(key string, after time.Time) {
+	element, exists := cache.hashmap[key]
+	if exists && cache.removable(element.Expiry, after) {
+		Logger.Infow("Evicting key due to expiry.",
+			"key", key,
+			"expiry", element.Expiry)
+		cache.remove(element)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (cache *TinyLFUCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return len(cache.hashmap)
+}
+
+// Stats returns the cache's hit and miss counts and its current size.
+func (cache *TinyLFUCache) Stats() Stats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return Stats{
+		Hits:   atomic.LoadUint64(&cache.hits),
+		Misses: atomic.LoadUint64(&cache.misses),
+		Len:    len(cache.hashmap),
+		Bytes:  cache.bytes,
+	}
+}
+
+// Flush atomicly removes every entry from the cache. The frequency sketch is
+// kept, as the keys' popularity hasn't changed.
+func (cache *TinyLFUCache) Flush() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	Logger.Infow("Flushing cache.", "size", len(cache.hashmap))
+	cache.window.Init()
+	cache.probation.Init()
+	cache.protected.Init()
+	cache.index.reset()
+	cache.hashmap = make(map[string]*tinyElement)
+	cache.bytes = 0
+}
+
+func (cache *TinyLFUCache) expire(now time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.decay.expire(now, cache.removeIfAfter)
+}
+
+// Start will start the Redeemer coroutine. The callee must call #Stop() to
+// allow GC to clean up the cache.
+func (cache *TinyLFUCache) Start() {
+	Logger.Infow("Redeemer routine started.")
+	go cache.redeemer(cache.expire)
+}
+
+// Stop will kill the Redeemer coroutine and allow GC to happen.
+func (cache *TinyLFUCache) Stop() {
+	cache.stop()
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTinyLFUConstructor(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewTinyLFUCache(0, time.Second, time.Minute)
+	assert.Nil(cache)
+	assert.NotNil(err)
+
+	cache, err = NewTinyLFUCache(1000, time.Second, time.Minute)
+	assert.Nil(err)
+	assert.Equal(10, cache.windowCap)
+	assert.Equal(792, cache.protectedCap)
+}
+
+func TestTinyLFUSimple(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewTinyLFUCache(10, time.Second, time.Minute)
+	assert.Nil(err)
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+
+	res, exists := cache.Get("1")
+	assert.Equal("test1", res)
+	assert.True(exists)
+
+	cache.Add("1", "test1-new", 0)
+	res, exists = cache.Get("1")
+	assert.Equal("test1-new", res)
+	assert.True(exists)
+
+	cache.Remove("2")
+	_, exists = cache.Get("2")
+	assert.False(exists)
+	assert.Equal(1, cache.Len())
+
+	cache.Flush()
+	assert.Equal(0, cache.Len())
+	assert.Equal(int64(0), cache.Stats().Bytes)
+}
+
+// A scan over many keys, each used once, must not evict the hot keys that are
+// still in use alongside it.
+func TestTinyLFUScanResistance(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewTinyLFUCache(100, time.Second, time.Minute)
+	assert.Nil(err)
+
+	hot := make([]string, 50)
+	for i := range hot {
+		hot[i] = "hot" + strconv.Itoa(i)
+		cache.Add(hot[i], "value", 0)
+	}
+	for round := 0; round < 5; round++ {
+		for _, key := range hot {
+			cache.Get(key)
+		}
+	}
+
+	for i := 0; i < 10000; i++ {
+		cache.Get(hot[i%len(hot)])
+		key := "scan" + strconv.Itoa(i)
+		if _, exists := cache.Get(key); !exists {
+			cache.Add(key, "value", 0)
+		}
+	}
+
+	for _, key := range hot {
+		_, exists := cache.Get(key)
+		assert.True(exists, key)
+	}
+	assert.True(cache.Len() <= 100)
+}
+
+func TestTinyLFUProtected(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewTinyLFUCache(10, time.Second, time.Minute)
+	assert.Nil(err)
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+	assert.Equal(segmentProbation, cache.hashmap["1"].segment)
+	assert.Equal(segmentWindow, cache.hashmap["2"].segment)
+
+	cache.Get("1")
+	assert.Equal(segmentProtected, cache.hashmap["1"].segment)
+}
+
+func TestTinyLFUMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewTinyLFUCache(10, time.Second, time.Minute)
+	assert.Nil(err)
+	cache.maxMemory = 2 * entrySize("1", "test1")
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+	cache.Add("3", "test3", 0)
+	assert.Equal(2, cache.Len())
+	assert.Equal(2*entrySize("1", "test1"), cache.Stats().Bytes)
+
+	_, exists := cache.Get("3")
+	assert.True(exists)
+}
+
+func TestTinyLFUTTL(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewTinyLFUCache(10, 50*time.Microsecond, 100*time.Millisecond)
+	assert.Nil(err)
+
+	cache.Start()
+	defer cache.Stop()
+
+	cache.Add("1", "test1", 0)
+	cache.Add("2", "test2", 0)
+	time.Sleep(200 * time.Millisecond)
+
+	_, exists := cache.Get("1")
+	assert.False(exists)
+	assert.Equal(0, cache.Len())
+}
+
+func TestCountMinSketch(t *testing.T) {
+	assert := assert.New(t)
+	sketch := newCountMinSketch(64)
+
+	for i := 0; i < 5; i++ {
+		sketch.increment("a")
+	}
+	sketch.increment("b")
+	assert.Equal(uint8(5), sketch.estimate("a"))
+	assert.Equal(uint8(1), sketch.estimate("b"))
+	assert.Equal(uint8(0), sketch.estimate("c"))
+
+	// Counters saturate.
+	for i := 0; i < 100; i++ {
+		sketch.increment("d")
+	}
+	assert.Equal(uint8(sketchMax), sketch.estimate("d"))
+
+	sketch.age()
+	assert.Equal(uint8(2), sketch.estimate("a"))
+	assert.Equal(uint8(0), sketch.estimate("b"))
+}
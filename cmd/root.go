@@ -17,12 +17,34 @@ import (
 var redisAddr string
 var redisPassword string
 var redisDb int
+var sentinelMaster string
+var sentinelAddrs []string
+var clusterAddrs []string
+var ringShards []string
+var ringHeartbeatMs int
+var replicaAddrs []string
+var replicaBalance string
+var replicaMaxLagMs int
+var replicaCheckPeriodMs int
 
 var cacheTTLMs int
 var cachePeriodMs int
 var cacheCapacity int
+var cacheMaxMemory int64
+var cacheShards int
+var cacheSoftTTLMs int
+var cacheRefreshAhead int
+var cacheStaleGraceMs int
+var negativeTTLMs int
+var negativeCapacity int
+var cacheEngine string
 
 var port int
+var maxBulkLength int
+var passthrough bool
+var passthroughDeny []string
+var clusterSlotMap []string
+var clusterAnnounceAddr string
 
 var cfgFile string
 
@@ -35,33 +57,174 @@ var RootCmd = &cobra.Command{
 		redisAddr = viper.GetString("redis_hostname")
 		redisPassword = viper.GetString("redis_password")
 		redisDb = viper.GetInt("redis_database")
+		sentinelMaster = viper.GetString("sentinel_master")
+		sentinelAddrs = viper.GetStringSlice("sentinel_addrs")
+		clusterAddrs = viper.GetStringSlice("cluster_addrs")
+		ringShards = viper.GetStringSlice("ring_shards")
+		ringHeartbeatMs = viper.GetInt("ring_heartbeat")
+		replicaAddrs = viper.GetStringSlice("replica_addrs")
+		replicaBalance = viper.GetString("replica_balance")
+		replicaMaxLagMs = viper.GetInt("replica_max_lag")
+		replicaCheckPeriodMs = viper.GetInt("replica_check_period")
 		cacheTTLMs = viper.GetInt("cache_ttl")
 		cachePeriodMs = viper.GetInt("cache_period")
 		cacheCapacity = viper.GetInt("capacity")
+		cacheMaxMemory = viper.GetInt64("max_memory")
+		cacheShards = viper.GetInt("cache_shards")
+		cacheSoftTTLMs = viper.GetInt("cache_soft_ttl")
+		cacheRefreshAhead = viper.GetInt("cache_refresh_ahead")
+		cacheStaleGraceMs = viper.GetInt("cache_stale_grace")
+		negativeTTLMs = viper.GetInt("negative_ttl")
+		negativeCapacity = viper.GetInt("negative_capacity")
+		cacheEngine = viper.GetString("cache_engine")
 		port = viper.GetInt("port")
+		maxBulkLength = viper.GetInt("max_bulk_length")
+		passthrough = viper.GetBool("passthrough")
+		passthroughDeny = viper.GetStringSlice("passthrough_deny")
+		clusterSlotMap = viper.GetStringSlice("cluster_slot_map")
+		clusterAnnounceAddr = viper.GetString("cluster_announce_addr")
 
 		Logger.Infow("Starting redis-proxy v0.1",
 			"redis-hostname", redisAddr,
+			"sentinel-master", sentinelMaster,
+			"cluster-addrs", clusterAddrs,
+			"ring-shards", ringShards,
+			"replica-addrs", replicaAddrs,
 			"ttl", cacheTTLMs,
+			"soft-ttl", cacheSoftTTLMs,
 			"capacity", cacheCapacity,
-			"port", port)
+			"max-memory", cacheMaxMemory,
+			"shards", cacheShards,
+			"engine", cacheEngine,
+			"port", port,
+			"passthrough", passthrough)
 
-		client := redis.NewClient(&redis.Options{
-			Addr:     redisAddr,
-			Password: redisPassword,
-			DB:       redisDb,
-		})
+		backends := 0
+		for _, set := range []bool{sentinelMaster != "", len(clusterAddrs) > 0, len(ringShards) > 0} {
+			if set {
+				backends++
+			}
+		}
+		if backends > 1 {
+			panic("Only one of sentinel_master, cluster_addrs and ring_shards may be set")
+		}
+		if len(replicaAddrs) > 0 && backends > 0 {
+			// Sentinel moves the primary, and the replicas with it, so a
+			// fixed list of replicas would go stale after a failover.
+			panic("replica_addrs can't be used with sentinel_master, cluster_addrs or ring_shards")
+		}
+
+		var client redis.UniversalClient
+		var detector *proxy.FailoverDetector
+		if len(clusterAddrs) > 0 {
+			// The cluster client finds the rest of the nodes from these, and
+			// follows slots as they move between them.
+			client = redis.NewClusterClient(&redis.ClusterOptions{
+				Addrs:    clusterAddrs,
+				Password: redisPassword,
+			})
+		} else if len(ringShards) > 0 {
+			// The ring drops shards that stop answering its heartbeat, and
+			// spreads their keys over the others until they're back.
+			addrs, err := proxy.RingAddrs(ringShards)
+			if err != nil {
+				panic("Error parsing ring shards: " + err.Error())
+			}
+			client = redis.NewRing(&redis.RingOptions{
+				Addrs:              addrs,
+				HeartbeatFrequency: time.Duration(ringHeartbeatMs) * time.Millisecond,
+				Password:           redisPassword,
+				DB:                 redisDb,
+			})
+		} else if sentinelMaster != "" {
+			// Sentinel tells the client where the primary is, and the detector
+			// has the cache flushed when that changes.
+			detector = &proxy.FailoverDetector{}
+			client = redis.NewFailoverClient(&redis.FailoverOptions{
+				MasterName:    sentinelMaster,
+				SentinelAddrs: sentinelAddrs,
+				Password:      redisPassword,
+				DB:            redisDb,
+				OnConnect:     detector.OnConnect,
+			})
+		} else {
+			client = redis.NewClient(&redis.Options{
+				Addr:     redisAddr,
+				Password: redisPassword,
+				DB:       redisDb,
+			})
+		}
 		Logger.Infow("Pinging backing redis", "response", client.Ping())
 
-		cache, err := cache.NewDecayingLRUCache(cacheCapacity,
-			time.Duration(cachePeriodMs)*time.Millisecond,
-			time.Duration(cacheTTLMs)*time.Millisecond)
+		values, err := cache.NewCache(&cache.Options{
+			Engine:       cacheEngine,
+			Capacity:     cacheCapacity,
+			MaxMemory:    cacheMaxMemory,
+			Period:       time.Duration(cachePeriodMs) * time.Millisecond,
+			TTL:          time.Duration(cacheTTLMs) * time.Millisecond,
+			Shards:       cacheShards,
+			SoftTTL:      time.Duration(cacheSoftTTLMs) * time.Millisecond,
+			RefreshAhead: cacheRefreshAhead,
+			StaleGrace:   time.Duration(cacheStaleGraceMs) * time.Millisecond,
+		})
 
 		if err != nil {
-			panic("Error creating cache")
+			panic("Error creating cache: " + err.Error())
+		}
+
+		// Missing keys are cached in a cache of their own, only if enabled.
+		var negative cache.Cache
+		if negativeTTLMs > 0 {
+			negative, err = cache.NewCache(&cache.Options{
+				Capacity: negativeCapacity,
+				Period:   time.Duration(cachePeriodMs) * time.Millisecond,
+				TTL:      time.Duration(negativeTTLMs) * time.Millisecond,
+				Shards:   cacheShards,
+			})
+			if err != nil {
+				panic("Error creating negative cache: " + err.Error())
+			}
+		}
+
+		// Reads only go to replicas if there are any.
+		var replicas *proxy.ReplicaSet
+		if len(replicaAddrs) > 0 {
+			var replicaClients []*redis.Client
+			for _, addr := range replicaAddrs {
+				replicaClients = append(replicaClients, redis.NewClient(&redis.Options{
+					Addr:     addr,
+					Password: redisPassword,
+					DB:       redisDb,
+				}))
+			}
+			replicas, err = proxy.NewReplicaSet(client, replicaClients, &proxy.ReplicaOptions{
+				Balance:     replicaBalance,
+				MaxLag:      time.Duration(replicaMaxLagMs) * time.Millisecond,
+				CheckPeriod: time.Duration(replicaCheckPeriodMs) * time.Millisecond,
+			})
+			if err != nil {
+				panic("Error creating replica set: " + err.Error())
+			}
+		}
+
+		// The proxy only pretends to be part of a cluster if given a slot map.
+		var slots *proxy.SlotMap
+		if len(clusterSlotMap) > 0 {
+			slots, err = proxy.ParseSlotMap(clusterAnnounceAddr, clusterSlotMap)
+			if err != nil {
+				panic("Error parsing cluster slot map: " + err.Error())
+			}
 		}
 
-		server := proxy.NewServer(cache, client)
+		server := proxy.NewServer(values, client, &proxy.Options{
+			MaxBulkLength:    maxBulkLength,
+			Passthrough:      passthrough,
+			DeniedCommands:   passthroughDeny,
+			NegativeCache:    negative,
+			FailoverDetector: detector,
+			SlotMap:          slots,
+			Replicas:         replicas,
+		})
 		server.Run(port)
 	},
 }
@@ -81,22 +244,72 @@ func init() {
 	RootCmd.Flags().String("redis_hostname", "localhost:6379", "The hostname for the backing redis cache.")
 	RootCmd.Flags().String("redis_password", "", "The password for the backing redis cache.")
 	RootCmd.Flags().Int("redis_database", 0, "The redis database to use. See https://redis.io/commands/select.")
+	RootCmd.Flags().String("sentinel_master", "", "The master name to ask Redis Sentinel for. If set, redis_hostname is ignored in favour of sentinel_addrs.")
+	RootCmd.Flags().StringSlice("sentinel_addrs", []string{"localhost:26379"}, "The host:port addresses of the Redis Sentinels.")
+	RootCmd.Flags().StringSlice("cluster_addrs", nil, "The host:port addresses of some Redis Cluster nodes. If set, the backend is that cluster instead of redis_hostname.")
+	RootCmd.Flags().StringSlice("ring_shards", nil, "Redis servers to shard keys across by consistent hashing, as name=host:port or name=host:port*weight. If set, used instead of redis_hostname.")
+	RootCmd.Flags().StringSlice("replica_addrs", nil, "The host:port addresses of replicas of the backing redis to send reads to.")
+	RootCmd.Flags().String("replica_balance", proxy.BalanceRoundRobin, "How reads are spread over the replicas: round-robin or latency.")
+	RootCmd.Flags().Int("replica_max_lag", 1000, "How far behind the backing redis a replica may be and still be read from, in milliseconds.")
+	RootCmd.Flags().Int("replica_check_period", 500, "How often the replication lag of the replicas is checked, in milliseconds.")
+	RootCmd.Flags().Int("ring_heartbeat", 500, "How often ring shards are pinged, in milliseconds. A shard is taken out of the ring after 3 failed pings.")
 
-	RootCmd.Flags().Int("capacity", 1024, "The maximum number of entries to cache.")
+	RootCmd.Flags().String("cache_engine", cache.EngineLRU, "The cache eviction policy: lru, lfu, tinylfu or none.")
+	RootCmd.Flags().Int("capacity", 1024, "The maximum number of entries to cache, or 0 for no limit.")
+	RootCmd.Flags().Int64("max_memory", 0, "The maximum memory used by cached keys and values, in bytes. The default, 0, is no limit.")
+	RootCmd.Flags().Int("cache_shards", 1, "The number of independently locked shards the cache is split into. With more than one, limits apply per shard and eviction is only approximately LRU.")
 	RootCmd.Flags().Int("cache_period", 100, "The periodicity of the cache eviction thread, in milliseconds.")
 	RootCmd.Flags().Int("cache_ttl", 5*60*1000, "A global TTL for cache entries, in milliseconds.")
+	RootCmd.Flags().Int("cache_soft_ttl", 0, "The age at which cache entries are refreshed in the background while still being served, in milliseconds, or 0 to disable.")
+	RootCmd.Flags().Int("cache_stale_grace", 0, "How long expired cache entries are kept to be served if the backing redis fails, in milliseconds.")
+	RootCmd.Flags().Int("cache_refresh_ahead", 0, "The number of reads after which an entry is refreshed ahead of its soft TTL, or 0 to disable.")
+
+	RootCmd.Flags().Int("negative_ttl", 0, "A TTL for caching that keys are missing, in milliseconds, or 0 to disable negative caching.")
+	RootCmd.Flags().Int("negative_capacity", 1024, "The maximum number of missing keys to cache.")
 
 	RootCmd.Flags().Int("port", 8001, "A open port used for listening.")
+	RootCmd.Flags().Int("max_bulk_length", proxy.DefaultMaxBulkLength, "The largest bulk string accepted from clients, in bytes.")
+
+	RootCmd.Flags().Bool("passthrough", false, "Forward commands the proxy doesn't handle to the backing redis.")
+	RootCmd.Flags().StringSlice("passthrough_deny", proxy.DefaultDeniedCommands, "Commands that are never forwarded in passthrough mode.")
+
+	RootCmd.Flags().StringSlice("cluster_slot_map", nil, "Present the proxy to clients as a Redis Cluster node, with hash slots assigned to proxies as host:port=start-end.")
+	RootCmd.Flags().String("cluster_announce_addr", "", "The host:port of this proxy in cluster_slot_map.")
 
 	viper.BindPFlag("redis_hostname", RootCmd.Flags().Lookup("redis_hostname"))
 	viper.BindPFlag("redis_password", RootCmd.Flags().Lookup("redis_password"))
 	viper.BindPFlag("redis_database", RootCmd.Flags().Lookup("redis_database"))
+	viper.BindPFlag("sentinel_master", RootCmd.Flags().Lookup("sentinel_master"))
+	viper.BindPFlag("sentinel_addrs", RootCmd.Flags().Lookup("sentinel_addrs"))
+	viper.BindPFlag("cluster_addrs", RootCmd.Flags().Lookup("cluster_addrs"))
+	viper.BindPFlag("ring_shards", RootCmd.Flags().Lookup("ring_shards"))
+	viper.BindPFlag("ring_heartbeat", RootCmd.Flags().Lookup("ring_heartbeat"))
+	viper.BindPFlag("replica_addrs", RootCmd.Flags().Lookup("replica_addrs"))
+	viper.BindPFlag("replica_balance", RootCmd.Flags().Lookup("replica_balance"))
+	viper.BindPFlag("replica_max_lag", RootCmd.Flags().Lookup("replica_max_lag"))
+	viper.BindPFlag("replica_check_period", RootCmd.Flags().Lookup("replica_check_period"))
 
+	viper.BindPFlag("cache_engine", RootCmd.Flags().Lookup("cache_engine"))
 	viper.BindPFlag("capacity", RootCmd.Flags().Lookup("capacity"))
+	viper.BindPFlag("max_memory", RootCmd.Flags().Lookup("max_memory"))
+	viper.BindPFlag("cache_shards", RootCmd.Flags().Lookup("cache_shards"))
 	viper.BindPFlag("cache_period", RootCmd.Flags().Lookup("cache_period"))
 	viper.BindPFlag("cache_ttl", RootCmd.Flags().Lookup("cache_ttl"))
+	viper.BindPFlag("cache_soft_ttl", RootCmd.Flags().Lookup("cache_soft_ttl"))
+	viper.BindPFlag("cache_stale_grace", RootCmd.Flags().Lookup("cache_stale_grace"))
+	viper.BindPFlag("cache_refresh_ahead", RootCmd.Flags().Lookup("cache_refresh_ahead"))
+
+	viper.BindPFlag("negative_ttl", RootCmd.Flags().Lookup("negative_ttl"))
+	viper.BindPFlag("negative_capacity", RootCmd.Flags().Lookup("negative_capacity"))
 
 	viper.BindPFlag("port", RootCmd.Flags().Lookup("port"))
+	viper.BindPFlag("max_bulk_length", RootCmd.Flags().Lookup("max_bulk_length"))
+
+	viper.BindPFlag("passthrough", RootCmd.Flags().Lookup("passthrough"))
+	viper.BindPFlag("passthrough_deny", RootCmd.Flags().Lookup("passthrough_deny"))
+
+	viper.BindPFlag("cluster_slot_map", RootCmd.Flags().Lookup("cluster_slot_map"))
+	viper.BindPFlag("cluster_announce_addr", RootCmd.Flags().Lookup("cluster_announce_addr"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// clusterNode is a proxy in a fleet advertised to clients as a Redis Cluster.
+type clusterNode struct {
+	// The node's address, as given to clients in MOVED redirects.
+	addr string
+	host string
+	port int
+	// A node id in the format Redis uses, derived from the address so that
+	// every proxy of the fleet agrees on it.
+	id string
+	// The slots the node serves, sorted.
+	ranges []slotRange
+}
+
+// slotRange is a range of hash slots, both ends inclusive.
+type slotRange struct {
+	start, end int
+}
+
+// SlotMap is the static assignment of hash slots to the proxies of a fleet
+// that presents itself to clients as a Redis Cluster, see ParseSlotMap.
+type SlotMap struct {
+	// The nodes in the order they were first given, and the node serving
+	// each slot, nil for slots no node serves.
+	nodes  []*clusterNode
+	owners [slotCount]*clusterNode
+	// This proxy's node.
+	self *clusterNode
+}
+
+// ParseSlotMap returns the SlotMap given by specs of the form
+// host:port=start-end, or host:port=slot, each assigning a range of slots to
+// the proxy at that address. A proxy serving several ranges is given once
+// for each. self is the address of this proxy, which must be one of them.
+// Slots can't be assigned twice, but may be left unassigned.
+func ParseSlotMap(self string, specs []string) (*SlotMap, error) {
+	slots := &SlotMap{}
+	byAddr := make(map[string]*clusterNode)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid slot range '%s', expected host:port=start-end", spec)
+		}
+		r, err := parseSlotRange(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid slot range '%s': %v", spec, err)
+		}
+
+		node, exists := byAddr[parts[0]]
+		if !exists {
+			node, err = newClusterNode(parts[0])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid slot range '%s': %v", spec, err)
+			}
+			byAddr[node.addr] = node
+			slots.nodes = append(slots.nodes, node)
+		}
+		for slot := r.start; slot <= r.end; slot++ {
+			if owner := slots.owners[slot]; owner != nil {
+				return nil, fmt.Errorf("Slot %d is assigned to both %s and %s", slot, owner.addr, node.addr)
+			}
+			slots.owners[slot] = node
+		}
+		node.ranges = append(node.ranges, r)
+	}
+
+	slots.self = byAddr[self]
+	if slots.self == nil {
+		return nil, fmt.Errorf("This proxy's address '%s' isn't in the slot map", self)
+	}
+	for _, node := range slots.nodes {
+		sort.Slice(node.ranges, func(i, j int) bool { return node.ranges[i].start < node.ranges[j].start })
+	}
+	return slots, nil
+}
+
+func newClusterNode(addr string) (*clusterNode, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s'", port)
+	}
+	id := sha1.Sum([]byte(addr))
+	return &clusterNode{addr: addr, host: host, port: portNum, id: hex.EncodeToString(id[:])}, nil
+}
+
+func parseSlotRange(s string) (slotRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return slotRange{}, fmt.Errorf("invalid slot '%s'", bounds[0])
+	}
+	end := start
+	if len(bounds) == 2 {
+		end, err = strconv.Atoi(bounds[1])
+		if err != nil {
+			return slotRange{}, fmt.Errorf("invalid slot '%s'", bounds[1])
+		}
+	}
+	if start < 0 || end >= slotCount || start > end {
+		return slotRange{}, fmt.Errorf("slots must be between 0 and %d, in order", slotCount-1)
+	}
+	return slotRange{start, end}, nil
+}
+
+// assigned returns the number of slots served by some node.
+func (slots *SlotMap) assigned() int {
+	n := 0
+	for _, owner := range slots.owners {
+		if owner != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// route returns the error reply for a command with the given keys if this
+// proxy shouldn't serve it, as a Redis Cluster node would: CROSSSLOT if the
+// keys are in different slots, CLUSTERDOWN if no node serves their slot, and
+// a MOVED redirect to the node that does if it's another one. Otherwise it
+// returns nil.
+func (slots *SlotMap) route(keys []string) Reply {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			return Error("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	owner := slots.owners[slot]
+	if owner == nil {
+		return Error("CLUSTERDOWN Hash slot not served")
+	}
+	if owner != slots.self {
+		return Error(fmt.Sprintf("MOVED %d %s", slot, owner.addr))
+	}
+	return nil
+}
+
+// clusterCommands replace the proxy's usual handling of CLUSTER subcommands
+// when it's part of a fleet advertised as a Redis Cluster.
+var clusterCommands = map[string]*commandSpec{
+	// Cluster clients send these for replica reads and slot migrations,
+	// neither of which a static slot map has.
+	"ASKING":    {arity: 1, handler: clusterOKHandler},
+	"READONLY":  {arity: 1, handler: clusterOKHandler},
+	"READWRITE": {arity: 1, handler: clusterOKHandler},
+
+	"CLUSTER|INFO":    {arity: 2, handler: clusterInfoHandler},
+	"CLUSTER|KEYSLOT": {arity: 3, handler: clusterKeySlotHandler},
+	"CLUSTER|MYID":    {arity: 2, handler: clusterMyIDHandler},
+	"CLUSTER|NODES":   {arity: 2, handler: clusterNodesHandler},
+	"CLUSTER|SHARDS":  {arity: 2, handler: clusterShardsHandler},
+	"CLUSTER|SLOTS":   {arity: 2, handler: clusterSlotsHandler},
+}
+
+var clusterOKHandler handler = func(sess *session, command *Command) (Reply, error) {
+	return SimpleString("OK"), nil
+}
+
+var clusterInfoHandler handler = func(sess *session, command *Command) (Reply, error) {
+	slots := sess.server.opt.SlotMap
+	assigned := slots.assigned()
+	state := "ok"
+	if assigned < slotCount {
+		state = "fail"
+	}
+	size := 0
+	for _, node := range slots.nodes {
+		if len(node.ranges) > 0 {
+			size++
+		}
+	}
+	myEpoch := 0
+	for i, node := range slots.nodes {
+		if node == slots.self {
+			myEpoch = i + 1
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&buf, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&buf, "cluster_slots_ok:%d\r\n", assigned)
+	fmt.Fprintf(&buf, "cluster_slots_pfail:0\r\n")
+	fmt.Fprintf(&buf, "cluster_slots_fail:0\r\n")
+	fmt.Fprintf(&buf, "cluster_known_nodes:%d\r\n", len(slots.nodes))
+	fmt.Fprintf(&buf, "cluster_size:%d\r\n", size)
+	fmt.Fprintf(&buf, "cluster_current_epoch:%d\r\n", len(slots.nodes))
+	fmt.Fprintf(&buf, "cluster_my_epoch:%d\r\n", myEpoch)
+	return Verbatim{Format: "txt", Text: buf.String()}, nil
+}
+
+var clusterKeySlotHandler handler = func(sess *session, command *Command) (Reply, error) {
+	return Integer(keySlot(command.Args[1])), nil
+}
+
+var clusterMyIDHandler handler = func(sess *session, command *Command) (Reply, error) {
+	return BulkString(sess.server.opt.SlotMap.self.id), nil
+}
+
+// clusterNodesHandler describes every node as a connected master, in the
+// format of Redis' nodes.conf. Nodes are given config epochs in the order
+// they appear in the slot map.
+var clusterNodesHandler handler = func(sess *session, command *Command) (Reply, error) {
+	slots := sess.server.opt.SlotMap
+	var buf bytes.Buffer
+	for i, node := range slots.nodes {
+		flags := "master"
+		if node == slots.self {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&buf, "%s %s@%d %s - 0 0 %d connected", node.id, node.addr, node.port+10000, flags, i+1)
+		for _, r := range node.ranges {
+			if r.start == r.end {
+				fmt.Fprintf(&buf, " %d", r.start)
+			} else {
+				fmt.Fprintf(&buf, " %d-%d", r.start, r.end)
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return BulkString(buf.String()), nil
+}
+
+// clusterShardsHandler describes each node as a shard of its own, without
+// replicas.
+var clusterShardsHandler handler = func(sess *session, command *Command) (Reply, error) {
+	slots := sess.server.opt.SlotMap
+	shards := make(Array, 0, len(slots.nodes))
+	for _, node := range slots.nodes {
+		ranges := make(Array, 0, 2*len(node.ranges))
+		for _, r := range node.ranges {
+			ranges = append(ranges, Integer(r.start), Integer(r.end))
+		}
+		shards = append(shards, Map{
+			BulkString("slots"), ranges,
+			BulkString("nodes"), Array{Map{
+				BulkString("id"), BulkString(node.id),
+				BulkString("port"), Integer(node.port),
+				BulkString("ip"), BulkString(node.host),
+				BulkString("endpoint"), BulkString(node.host),
+				BulkString("role"), BulkString("master"),
+				BulkString("replication-offset"), Integer(0),
+				BulkString("health"), BulkString("online"),
+			}},
+		})
+	}
+	return shards, nil
+}
+
+// clusterSlotsHandler lists every range of slots with the node serving it,
+// in order of slot.
+var clusterSlotsHandler handler = func(sess *session, command *Command) (Reply, error) {
+	slots := sess.server.opt.SlotMap
+	var replies Array
+	for slot := 0; slot < slotCount; {
+		owner := slots.owners[slot]
+		if owner == nil {
+			slot++
+			continue
+		}
+		var r slotRange
+		for _, r = range owner.ranges {
+			if r.start <= slot && slot <= r.end {
+				break
+			}
+		}
+		replies = append(replies, Array{
+			Integer(r.start),
+			Integer(r.end),
+			Array{BulkString(owner.host), Integer(owner.port), BulkString(owner.id)},
+		})
+		slot = r.end + 1
+	}
+	return replies, nil
+}
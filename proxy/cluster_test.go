@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eastside-eng/redis-proxy/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSlotMap = []string{
+	"10.0.0.1:7000=0-8191",
+	"10.0.0.2:7000=8192-16000",
+	"10.0.0.1:7000=16001-16383",
+}
+
+func TestParseSlotMap(t *testing.T) {
+	slots, err := ParseSlotMap("10.0.0.1:7000", testSlotMap)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(slots.nodes))
+	assert.Equal(t, slotCount, slots.assigned())
+	assert.Equal(t, []slotRange{{0, 8191}, {16001, 16383}}, slots.self.ranges)
+	assert.Equal(t, 40, len(slots.self.id))
+
+	_, err = ParseSlotMap("10.0.0.3:7000", testSlotMap)
+	assert.NotNil(t, err)
+	_, err = ParseSlotMap("10.0.0.1:7000", []string{"10.0.0.1:7000=0-10", "10.0.0.2:7000=10"})
+	assert.NotNil(t, err)
+	_, err = ParseSlotMap("10.0.0.1:7000", []string{"10.0.0.1:7000=0-16384"})
+	assert.NotNil(t, err)
+	_, err = ParseSlotMap("10.0.0.1:7000", []string{"10.0.0.1=0-10"})
+	assert.NotNil(t, err)
+	_, err = ParseSlotMap("10.0.0.1:7000", []string{"10.0.0.1:7000"})
+	assert.NotNil(t, err)
+
+	// Unassigned slots aren't served by anyone.
+	slots, err = ParseSlotMap("10.0.0.1:7000", []string{"10.0.0.1:7000=0-99"})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, slots.assigned())
+	assert.Equal(t, Error("CLUSTERDOWN Hash slot not served"), slots.route([]string{"foo"}))
+}
+
+func TestSlotMapRoute(t *testing.T) {
+	slots, _ := ParseSlotMap("10.0.0.1:7000", testSlotMap)
+	// bar is in slot 5061, foo in 12182.
+	assert.Nil(t, slots.route(nil))
+	assert.Nil(t, slots.route([]string{"bar"}))
+	assert.Nil(t, slots.route([]string{"bar", "{bar}.x"}))
+	assert.Equal(t, Error("MOVED 12182 10.0.0.2:7000"), slots.route([]string{"foo"}))
+	assert.Equal(t, Error("CROSSSLOT Keys in request don't hash to the same slot"), slots.route([]string{"bar", "foo"}))
+}
+
+func TestClusterEmulation(t *testing.T) {
+	slots, _ := ParseSlotMap("10.0.0.1:7000", testSlotMap)
+	values, _ := cache.NewCache(&cache.Options{Capacity: 10, Period: time.Second, TTL: time.Minute})
+	server := NewServer(values, nil, &Options{SlotMap: slots})
+	sess := server.newSession(nil)
+	values.Add("bar", "value", 0)
+
+	resp := server.processCommand(sess, &Command{Name: "GET", Args: []string{"bar"}})
+	assert.Equal(t, BulkString("value"), resp)
+	resp = server.processCommand(sess, &Command{Name: "GET", Args: []string{"foo"}})
+	assert.Equal(t, Error("MOVED 12182 10.0.0.2:7000"), resp)
+	resp = server.processCommand(sess, &Command{Name: "MSET", Args: []string{"bar", "1", "foo", "2"}})
+	assert.Equal(t, Error("CROSSSLOT Keys in request don't hash to the same slot"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "READONLY"})
+	assert.Equal(t, SimpleString("OK"), resp)
+	resp = server.processCommand(sess, &Command{Name: "CLUSTER", Args: []string{"KEYSLOT", "foo"}})
+	assert.Equal(t, Integer(12182), resp)
+	resp = server.processCommand(sess, &Command{Name: "CLUSTER", Args: []string{"myid"}})
+	assert.Equal(t, BulkString(slots.self.id), resp)
+
+	other := slots.nodes[1]
+	resp = server.processCommand(sess, &Command{Name: "CLUSTER", Args: []string{"SLOTS"}})
+	assert.Equal(t, Array{
+		Array{Integer(0), Integer(8191), Array{BulkString("10.0.0.1"), Integer(7000), BulkString(slots.self.id)}},
+		Array{Integer(8192), Integer(16000), Array{BulkString("10.0.0.2"), Integer(7000), BulkString(other.id)}},
+		Array{Integer(16001), Integer(16383), Array{BulkString("10.0.0.1"), Integer(7000), BulkString(slots.self.id)}},
+	}, resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLUSTER", Args: []string{"NODES"}})
+	assert.Equal(t, BulkString(
+		slots.self.id+" 10.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-8191 16001-16383\n"+
+			other.id+" 10.0.0.2:7000@17000 master - 0 0 2 connected 8192-16000\n"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLUSTER", Args: []string{"SHARDS"}})
+	shards := resp.(Array)
+	assert.Equal(t, 2, len(shards))
+	assert.Equal(t, Array{Integer(8192), Integer(16000)}, shards[1].(Map)[1])
+
+	resp = server.processCommand(sess, &Command{Name: "CLUSTER", Args: []string{"INFO"}})
+	info := resp.(Verbatim).Text
+	assert.Contains(t, info, "cluster_state:ok\r\n")
+	assert.Contains(t, info, "cluster_known_nodes:2\r\n")
+	assert.Contains(t, info, "cluster_my_epoch:1\r\n")
+
+	resp = server.processCommand(sess, &Command{Name: "INFO", Args: []string{"cluster"}})
+	assert.Equal(t, Verbatim{Format: "txt", Text: "# Cluster\r\ncluster_enabled:1\r\n"}, resp)
+}
+
+func TestClusterEmulationNumKeys(t *testing.T) {
+	slots, _ := ParseSlotMap("10.0.0.1:7000", testSlotMap)
+	server := NewServer(&cache.NoopCache{}, nil, &Options{SlotMap: slots, Passthrough: true})
+	sess := server.newSession(nil)
+
+	// The source keys are checked as well as the destination.
+	resp := server.processCommand(sess, &Command{Name: "ZUNIONSTORE", Args: []string{"bar", "2", "{bar}.x", "foo"}})
+	assert.Equal(t, Error("CROSSSLOT Keys in request don't hash to the same slot"), resp)
+	resp = server.processCommand(sess, &Command{Name: "EVAL", Args: []string{"return 1", "1", "foo"}})
+	assert.Equal(t, Error("MOVED 12182 10.0.0.2:7000"), resp)
+}
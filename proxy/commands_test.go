@@ -41,3 +41,11 @@ func TestParserPingCommand(t *testing.T) {
 	assert.Equal(t, "PING", out.Name)
 	assert.Equal(t, 0, len(out.Args))
 }
+
+func TestParserInlineCommand(t *testing.T) {
+	raw := []byte("set mykey \"my value\"\r\n")
+	out, err := parseCommand(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, "SET", out.Name)
+	assert.Equal(t, []string{"mykey", "my value"}, out.Args)
+}
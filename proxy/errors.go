@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// maxErrorArgsLength bounds how much of a bad command is echoed back in an
+// error reply, matching Redis.
+const maxErrorArgsLength = 128
+
+// unknownCommandError returns the reply Redis gives for a command it doesn't
+// implement, e.g. -ERR unknown command 'FOO', with args beginning with: 'bar'
+func unknownCommandError(command *Command) Error {
+	var args strings.Builder
+	for _, arg := range command.Args {
+		if args.Len() >= maxErrorArgsLength {
+			break
+		}
+		fmt.Fprintf(&args, "'%s' ", truncate(arg, maxErrorArgsLength-args.Len()))
+	}
+	return Error(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s",
+		truncate(command.Name, maxErrorArgsLength), args.String()))
+}
+
+// wrongArityError returns the reply Redis gives when a command is called with
+// the wrong number of arguments. name is the full name of the command, e.g.
+// CLIENT|SETNAME for a subcommand.
+func wrongArityError(name string) Error {
+	return Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+// errorReply converts an error into the reply sent to the client. Error
+// replies, whether our own or relayed from the backend, are passed through
+// unchanged and anything else becomes a generic -ERR.
+func errorReply(err error) Error {
+	if e, ok := err.(Error); ok {
+		return e
+	}
+	if isReplyError(err) {
+		return Error(err.Error())
+	}
+	return Error("ERR " + err.Error())
+}
+
+// isReplyError reports whether an error returned by go-redis is an error
+// reply from the backend, e.g. WRONGTYPE, rather than a failure to talk to it.
+// go-redis doesn't export its reply error type; every error it creates itself
+// is either a network error or prefixed with "redis: ".
+func isReplyError(err error) bool {
+	if err == io.EOF {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return false
+	}
+	return !strings.HasPrefix(err.Error(), "redis: ")
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
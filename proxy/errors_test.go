@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownCommandError(t *testing.T) {
+	err := unknownCommandError(&Command{Name: "FOO", Args: []string{"bar", "baz"}})
+	assert.Equal(t, Error("ERR unknown command 'FOO', with args beginning with: 'bar' 'baz' "), err)
+
+	err = unknownCommandError(&Command{Name: "FOO"})
+	assert.Equal(t, Error("ERR unknown command 'FOO', with args beginning with: "), err)
+
+	err = unknownCommandError(&Command{Name: "FOO", Args: []string{strings.Repeat("x", 200), "y"}})
+	assert.Equal(t, Error("ERR unknown command 'FOO', with args beginning with: '"+strings.Repeat("x", 128)+"' "), err)
+}
+
+func TestWrongArityError(t *testing.T) {
+	err := wrongArityError("GET")
+	assert.Equal(t, Error("ERR wrong number of arguments for 'get' command"), err)
+
+	err = wrongArityError("CLIENT|SETNAME")
+	assert.Equal(t, Error("ERR wrong number of arguments for 'client|setname' command"), err)
+}
+
+func TestErrorReply(t *testing.T) {
+	assert.Equal(t, Error("NOPROTO unsupported protocol version"), errorReply(Error("NOPROTO unsupported protocol version")))
+	assert.Equal(t, Error("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		errorReply(errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")))
+	assert.Equal(t, Error("ERR redis: connection pool timeout"), errorReply(errors.New("redis: connection pool timeout")))
+	assert.Equal(t, Error("ERR EOF"), errorReply(io.EOF))
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/eastside-eng/redis-proxy/log"
+	"github.com/go-redis/redis"
+)
+
+// FailoverDetector notices when the backend's connections reach a different
+// Redis server than before, as they do after a Sentinel failover promotes a
+// replica. The new primary may not have the most recent writes, so the
+// Server it's given to drops everything it has cached.
+//
+// Servers are told apart by the run_id in INFO, which also changes when a
+// server restarts and may have lost data the same way.
+type FailoverDetector struct {
+	lock  sync.Mutex
+	runID string
+	// Called when the run_id changes, see NewServer.
+	onFailover func()
+}
+
+// OnConnect is meant to be used as the OnConnect option of the backend client.
+// It checks which server every new connection reached.
+func (d *FailoverDetector) OnConnect(conn *redis.Conn) error {
+	info, err := conn.Info("server").Result()
+	if err != nil {
+		// Not being able to tell is no reason to refuse the connection.
+		Logger.Warnw("Failed to identify backend", "err", err)
+		return nil
+	}
+	d.observe(infoField(info, "run_id"))
+	return nil
+}
+
+// observe records the run_id of a connection, and reports a failover if it's
+// not the one seen before.
+func (d *FailoverDetector) observe(runID string) {
+	if runID == "" {
+		return
+	}
+
+	d.lock.Lock()
+	previous := d.runID
+	d.runID = runID
+	onFailover := d.onFailover
+	d.lock.Unlock()
+
+	if previous != "" && previous != runID {
+		Logger.Warnw("Backend changed, flushing cache", "previous", previous, "current", runID)
+		if onFailover != nil {
+			onFailover()
+		}
+	}
+}
+
+// setOnFailover sets the function called when a failover is detected.
+func (d *FailoverDetector) setOnFailover(fn func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.onFailover = fn
+}
+
+// infoField returns the value of the named field in an INFO reply, or "" if
+// there's no such field.
+func infoField(info string, name string) string {
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, name+":") {
+			return line[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// failover drops every cached value and missing key, as the backend they were
+// read from has been replaced.
+func (s *Server) failover() {
+	atomic.AddUint64(&s.failovers, 1)
+	s.flush()
+}
+
+// flush drops every cached value and missing key. Like a write, it stops
+// fetches already in flight from filling the cache with what they read before.
+func (s *Server) flush() {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	atomic.AddUint64(&s.writeEpoch, 1)
+
+	s.flights.forgetAll()
+	s.cache.Flush()
+	s.negative.Flush()
+}
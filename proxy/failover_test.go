@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eastside-eng/redis-proxy/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfoField(t *testing.T) {
+	info := "# Server\r\nredis_version:4.0.1\r\nrun_id:abc123\r\ntcp_port:6379\r\n"
+	assert.Equal(t, "abc123", infoField(info, "run_id"))
+	assert.Equal(t, "6379", infoField(info, "tcp_port"))
+	assert.Equal(t, "", infoField(info, "run"))
+}
+
+func TestFailoverDetector(t *testing.T) {
+	values, _ := cache.NewCache(&cache.Options{Capacity: 10, Period: time.Second, TTL: time.Minute})
+	negative, _ := cache.NewCache(&cache.Options{Capacity: 10, Period: time.Second, TTL: time.Minute})
+	detector := &FailoverDetector{}
+	// Connections made before the server exists are only recorded.
+	detector.observe("first")
+	server := NewServer(values, nil, &Options{NegativeCache: negative, FailoverDetector: detector})
+
+	values.Add("key", "value", 0)
+	negative.Add("missing", true, 0)
+
+	// More connections to the same server change nothing.
+	detector.observe("first")
+	detector.observe("")
+	assert.Equal(t, 1, values.Len())
+	assert.Equal(t, uint64(0), server.failovers)
+
+	detector.observe("second")
+	assert.Equal(t, 0, values.Len())
+	assert.Equal(t, 0, negative.Len())
+	assert.Equal(t, uint64(1), server.failovers)
+	assert.Equal(t, uint64(1), server.writeEpoch)
+}
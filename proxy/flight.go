@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// flightKey identifies the value a fetch from the backend is for.
+type flightKey struct {
+	db  int
+	key string
+}
+
+// flight is a fetch of one key from the backend that other connections may
+// wait on instead of making their own.
+type flight struct {
+	done  chan struct{}
+	reply Reply
+}
+
+// flightGroup deduplicates concurrent fetches of the same key, so that when a
+// hot key misses the cache only one request for it reaches the backend.
+type flightGroup struct {
+	// The number of fetches that waited on another's result. Accessed
+	// atomically, kept first for 64 bit alignment.
+	coalesced uint64
+
+	lock    sync.Mutex
+	flights map[flightKey]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[flightKey]*flight)}
+}
+
+// join returns the flight for the key and whether the caller leads it. The
+// leader must fetch the key and call land, everyone else waits for the
+// leader's reply.
+func (g *flightGroup) join(key flightKey) (*flight, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if f, exists := g.flights[key]; exists {
+		atomic.AddUint64(&g.coalesced, 1)
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// land completes the flight with the reply the leader fetched.
+func (g *flightGroup) land(key flightKey, f *flight, reply Reply) {
+	g.lock.Lock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.lock.Unlock()
+
+	f.reply = reply
+	close(f.done)
+}
+
+// forget stops later fetches of the key from joining the flight in progress,
+// e.g. because the key was just written and the flight may return the old
+// value. Those already waiting still get its reply.
+func (g *flightGroup) forget(key flightKey) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	delete(g.flights, key)
+}
+
+// wait blocks until the flight has landed and returns its reply.
+func (f *flight) wait() Reply {
+	<-f.done
+	return f.reply
+}
+
+// Coalesced returns the number of fetches that were answered by another
+// connection's fetch of the same key.
+func (g *flightGroup) Coalesced() uint64 {
+	return atomic.LoadUint64(&g.coalesced)
+}
+
+// forgetAll stops later fetches of any key from joining the flights in
+// progress, e.g. because the backend they're fetching from was replaced.
+func (g *flightGroup) forgetAll() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.flights = make(map[flightKey]*flight)
+}
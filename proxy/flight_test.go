@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroup(t *testing.T) {
+	group := newFlightGroup()
+	key := flightKey{0, "hot"}
+
+	leader, leads := group.join(key)
+	assert.True(t, leads)
+
+	var wg sync.WaitGroup
+	replies := make([]Reply, 10)
+	for i := range replies {
+		f, leads := group.join(key)
+		assert.False(t, leads)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i] = f.wait()
+		}(i)
+	}
+
+	group.land(key, leader, BulkString("value"))
+	wg.Wait()
+	for _, resp := range replies {
+		assert.Equal(t, BulkString("value"), resp)
+	}
+	assert.Equal(t, uint64(10), group.Coalesced())
+
+	// Once landed, the next fetch leads a new flight.
+	_, leads = group.join(key)
+	assert.True(t, leads)
+}
+
+func TestFlightGroupForget(t *testing.T) {
+	group := newFlightGroup()
+	key := flightKey{0, "written"}
+
+	old, _ := group.join(key)
+	group.forget(key)
+	f, leads := group.join(key)
+	assert.True(t, leads)
+
+	// Landing the forgotten flight leaves the new one in place.
+	group.land(key, old, BulkString("old"))
+	_, leads = group.join(key)
+	assert.False(t, leads)
+	group.land(key, f, BulkString("new"))
+}
+
+func TestFetchKeysLandsOnPanic(t *testing.T) {
+	backend := newFakeRedis(t, map[string]string{"GET": "$1\r\nv\r\n", "PTTL": ":-1\r\n"})
+	hold := make(chan struct{})
+	backend.lock.Lock()
+	backend.hold = hold
+	backend.lock.Unlock()
+	defer backend.close()
+	// Without a cache, caching the value fetched panics.
+	server := NewServer(nil, redis.NewClient(&redis.Options{Addr: backend.addr()}), &Options{})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		server.fetchKeys([]string{"hot"})
+	}()
+	for {
+		server.flights.lock.Lock()
+		_, flying := server.flights.flights[flightKey{0, "hot"}]
+		server.flights.lock.Unlock()
+		if flying {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f, leads := server.flights.join(flightKey{0, "hot"})
+	assert.False(t, leads)
+
+	close(hold)
+	assert.NotNil(t, <-panicked)
+	assert.Equal(t, failedFetchError, f.wait())
+}
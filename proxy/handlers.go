@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/eastside-eng/redis-proxy/log"
+	"github.com/go-redis/redis"
+)
+
+// compatibleVersion is the Redis version reported to clients by HELLO. It is
+// the first release that speaks RESP3, which is what clients use it to detect.
+const compatibleVersion = "6.0.0"
+
+// Handlers are executed per-command and should execute any side effects.
+type handler func(sess *session, command *Command) (Reply, error)
+
+var getHandler handler = func(sess *session, command *Command) (Reply, error) {
+	key := command.Args[0]
+	resp, exists := sess.server.cached(key)
+	Logger.Infow("Invoking GET on cache",
+		"key", key,
+		"cache-entry", resp)
+	if !exists {
+		return sess.server.fetchKeys([]string{key})[0], nil
+	}
+	return resp, nil
+}
+
+// cached returns the reply to GET the key from the caches, if known: its value
+// from the cache, or a nil reply if it's in the negative cache of keys known
+// to be missing.
+func (s *Server) cached(key string) (Reply, bool) {
+	if val, exists := s.cache.Get(key); exists {
+		return BulkString(val.(string)), true
+	}
+	if _, missing := s.negative.Get(key); missing {
+		return NullBulk, true
+	}
+	return nil, false
+}
+
+// fetchKeys returns the value of each of the keys from the backing Redis. A
+// key that another connection is already fetching isn't fetched again, and
+// waits for that fetch's reply instead. The rest are fetched with getKeys.
+func (s *Server) fetchKeys(keys []string) []Reply {
+	replies := make([]Reply, len(keys))
+	var leading []string
+	var leadingAt []int
+	var flights []*flight
+	waiting := make(map[int]*flight)
+	for i, key := range keys {
+		f, leader := s.flights.join(flightKey{s.db, key})
+		if leader {
+			leading = append(leading, key)
+			leadingAt = append(leadingAt, i)
+			flights = append(flights, f)
+		} else {
+			waiting[i] = f
+		}
+	}
+
+	if len(leading) > 0 {
+		landed := 0
+		defer func() {
+			// Only if the fetch panicked, so that its waiters aren't left
+			// waiting forever.
+			for i := landed; i < len(leading); i++ {
+				s.flights.land(flightKey{s.db, leading[i]}, flights[i], failedFetchError)
+			}
+		}()
+		for i, resp := range s.getKeys(leading) {
+			replies[leadingAt[i]] = resp
+			s.flights.land(flightKey{s.db, leading[i]}, flights[i], resp)
+			landed++
+		}
+	}
+	// Our own flights have landed first, so waiting on a key that appears
+	// twice in keys, or on a connection that waits on us, can't deadlock.
+	for i, f := range waiting {
+		replies[i] = f.wait()
+	}
+	return replies
+}
+
+// failedFetchError is the reply waiters get from a fetch that failed without
+// a reply of its own.
+var failedFetchError = Error("ERR fetch from backend failed")
+
+// getKeys GETs each of the keys from the backing Redis in one pipelined
+// round-trip, populating the cache with any values found. The replies are
+// returned in the order of keys. The PTTL of each key is fetched alongside it
+// so that cache entries don't outlive the keys they hold, see cacheTTL.
+//
+// If a write went through the proxy while the GETs were in flight, the values
+// read may predate it and the cache is left alone. See applyWrite.
+func (s *Server) getKeys(keys []string) []Reply {
+	epoch := atomic.LoadUint64(&s.writeEpoch)
+
+	pipe := s.reader(keys).Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(key)
+		ttls[i] = pipe.PTTL(key)
+	}
+	// Errors are reported per command below.
+	pipe.Exec()
+
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	stale := s.writeEpoch != epoch
+
+	replies := make([]Reply, len(keys))
+	for i, cmd := range cmds {
+		val, err := cmd.Result()
+		Logger.Infow("Invoking GET on backing Redis",
+			"key", keys[i],
+			"redis-entry", val)
+		if err == redis.Nil {
+			if !stale {
+				s.negative.Add(keys[i], true, 0)
+			}
+			replies[i] = NullBulk
+			continue
+		}
+		if err != nil {
+			Logger.Warnw("GET failed on backing Redis", "key", keys[i], "err", err)
+			if resp, ok := s.serveStale(keys[i], err); ok {
+				replies[i] = resp
+			} else {
+				replies[i] = errorReply(err)
+			}
+			continue
+		}
+		if !stale {
+			s.cacheValue(keys[i], val, ttls[i])
+		}
+		replies[i] = BulkString(val)
+	}
+	return replies
+}
+
+// serveStale returns the expired cached value of the key, if it's still in the
+// cache's grace window, in place of the backend error err. Errors the backend
+// replied with, e.g. WRONGTYPE, are returned as is, as the backend is working.
+func (s *Server) serveStale(key string, err error) (Reply, bool) {
+	if isReplyError(err) {
+		return nil, false
+	}
+	val, exists := s.cache.GetStale(key)
+	if !exists {
+		return nil, false
+	}
+	Logger.Warnw("Serving stale value as backing Redis failed", "key", key, "err", err)
+	atomic.AddUint64(&s.staleServed, 1)
+	return BulkString(val.(string)), true
+}
+
+// cacheValue adds a value read from the backing Redis to the cache, unless
+// the key's PTTL shows that it has since expired or couldn't be read.
+func (s *Server) cacheValue(key string, val string, pttl *redis.DurationCmd) {
+	d, err := pttl.Result()
+	if err != nil {
+		Logger.Warnw("PTTL failed on backing Redis", "key", key, "err", err)
+		return
+	}
+	if ttl, ok := cacheTTL(d); ok {
+		s.cache.Add(key, val, ttl)
+		s.negative.Remove(key)
+	}
+}
+
+// cacheTTL converts the PTTL of a key into the TTL to cache it with. Keys
+// without an expiry, which have a PTTL of -1, get the cache's own TTL. ok is
+// false for keys that have expired, or are about to.
+func cacheTTL(pttl time.Duration) (ttl time.Duration, ok bool) {
+	switch {
+	case pttl == -time.Millisecond:
+		return 0, true
+	case pttl > 0:
+		return pttl, true
+	}
+	return 0, false
+}
+
+// refresh fetches a stale key from the backend in the background, putting the
+// new value in the cache. Until then, reads are served the stale value. A key
+// that has gone from the backend is removed from the cache.
+func (s *Server) refresh(key string) {
+	atomic.AddUint64(&s.refreshes, 1)
+	go func() {
+		Logger.Infow("Refreshing stale key", "key", key)
+		if s.fetchKeys([]string{key})[0] == NullBulk {
+			s.cache.Remove(key)
+		}
+	}()
+}
+
+// mgetHandler serves whichever keys it can from the cache and fetches the rest
+// from the backend with a single MGET.
+var mgetHandler handler = func(sess *session, command *Command) (Reply, error) {
+	keys := command.Args
+	replies := make(Array, len(keys))
+	var missing []string
+	var missingAt []int
+	for i, key := range keys {
+		if resp, exists := sess.server.cached(key); exists {
+			replies[i] = resp
+		} else {
+			missing = append(missing, key)
+			missingAt = append(missingAt, i)
+		}
+	}
+	Logger.Infow("Invoking MGET on cache",
+		"keys", len(keys),
+		"misses", len(missing))
+	if len(missing) == 0 {
+		return replies, nil
+	}
+
+	fetched, err := sess.server.mgetKeys(missing)
+	if err != nil {
+		// Only serve stale values if there's one for every key we're missing.
+		fetched = make([]Reply, len(missing))
+		for i, key := range missing {
+			resp, ok := sess.server.serveStale(key, err)
+			if !ok {
+				return nil, err
+			}
+			fetched[i] = resp
+		}
+	}
+	for i, resp := range fetched {
+		replies[missingAt[i]] = resp
+	}
+	return replies, nil
+}
+
+// mgetKeys fetches the keys from the backing Redis with one MGET, or one per
+// group of keys of a sharded backend, populating the cache with any values
+// found in the same way as getKeys. The MGETs are pipelined with the PTTL of
+// each key.
+func (s *Server) mgetKeys(keys []string) ([]Reply, error) {
+	epoch := atomic.LoadUint64(&s.writeEpoch)
+
+	pipe := s.reader(keys).Pipeline()
+	defer pipe.Close()
+
+	groups := s.keyGroups(keys)
+	mgets := make([]*redis.SliceCmd, len(groups))
+	for i, group := range groups {
+		mgets[i] = pipe.MGet(pick(keys, group)...)
+	}
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.PTTL(key)
+	}
+	// Errors are reported per command below.
+	pipe.Exec()
+
+	vals := make([]interface{}, len(keys))
+	for i, mget := range mgets {
+		groupVals, err := mget.Result()
+		Logger.Infow("Invoking MGET on backing Redis", "keys", len(groups[i]), "err", err)
+		if err != nil {
+			return nil, err
+		}
+		for j, at := range groups[i] {
+			vals[at] = groupVals[j]
+		}
+	}
+
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	stale := s.writeEpoch != epoch
+
+	replies := make([]Reply, len(keys))
+	for i, val := range vals {
+		str, ok := val.(string)
+		if !ok {
+			// Missing keys, and keys holding something other than a string.
+			// Only the former have no PTTL, and are negatively cached.
+			if !stale && ttls[i].Val() == -2*time.Millisecond {
+				s.negative.Add(keys[i], true, 0)
+			}
+			replies[i] = NullBulk
+			continue
+		}
+		if !stale {
+			s.cacheValue(keys[i], str, ttls[i])
+		}
+		replies[i] = BulkString(str)
+	}
+	return replies, nil
+}
+
+// pick returns the keys at the given indexes.
+func pick(keys []string, indexes []int) []string {
+	picked := make([]string, len(indexes))
+	for i, at := range indexes {
+		picked[i] = keys[at]
+	}
+	return picked
+}
+
+// existsHandler counts the keys known to exist, or not, from the caches and
+// asks the backend about the rest with a single EXISTS. As in Redis, a key
+// given more than once is counted each time.
+var existsHandler handler = func(sess *session, command *Command) (Reply, error) {
+	var count int64
+	var unknown []string
+	for _, key := range command.Args {
+		resp, known := sess.server.cached(key)
+		if !known {
+			unknown = append(unknown, key)
+		} else if resp != NullBulk {
+			count++
+		}
+	}
+	if len(unknown) > 0 {
+		resp, err := forwardSplit(sess.server, sess.server.reader(unknown), &Command{Name: "EXISTS", Args: unknown})
+		if err != nil {
+			return nil, err
+		}
+		n, ok := resp.(Integer)
+		if !ok {
+			return nil, unexpectedReplyError
+		}
+		count += int64(n)
+	}
+	return Integer(count), nil
+}
+
+var pingHandler handler = func(sess *session, command *Command) (Reply, error) {
+	if len(command.Args) > 1 {
+		return wrongArityError(command.Name), nil
+	}
+	if len(command.Args) > 0 {
+		return BulkString(command.Args[0]), nil
+	}
+	return SimpleString("PONG"), nil
+}
+
+// forwardHandler passes a command through to the backend, either because it
+// is registered as forwarded or because of pass-through mode.
+var forwardHandler handler = func(sess *session, command *Command) (Reply, error) {
+	return forward(sess.server.clientFor(command), command)
+}
+
+// helloHandler implements HELLO [protover [AUTH username password] [SETNAME clientname]].
+// The proxy has no authentication of its own, so AUTH is accepted and ignored.
+var helloHandler handler = func(sess *session, command *Command) (Reply, error) {
+	args := command.Args
+	version := sess.protocol
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return Error("ERR Protocol version is not an integer or out of range"), nil
+		}
+		if v != 2 && v != 3 {
+			return Error("NOPROTO unsupported protocol version"), nil
+		}
+		version = v
+		args = args[1:]
+	}
+
+	name := sess.name
+	for len(args) > 0 {
+		switch option := strings.ToUpper(args[0]); {
+		case option == "AUTH" && len(args) >= 3:
+			args = args[3:]
+		case option == "SETNAME" && len(args) >= 2:
+			if !validClientName(args[1]) {
+				return invalidClientNameError, nil
+			}
+			name = args[1]
+			args = args[2:]
+		default:
+			return Error("ERR Syntax error in HELLO option '" + args[0] + "'"), nil
+		}
+	}
+
+	mode := "standalone"
+	if sess.server.opt.SlotMap != nil {
+		mode = "cluster"
+	}
+	sess.name = name
+	sess.setProtocol(version)
+	return Map{
+		BulkString("server"), BulkString("redis"),
+		BulkString("version"), BulkString(compatibleVersion),
+		BulkString("proto"), Integer(version),
+		BulkString("id"), Integer(sess.id),
+		BulkString("mode"), BulkString(mode),
+		BulkString("role"), BulkString("master"),
+		BulkString("modules"), Array{},
+	}, nil
+}
+
+var invalidClientNameError = Error("ERR Client names cannot contain spaces, newlines or special characters.")
+
+// validClientName reports whether name is acceptable to CLIENT SETNAME. Like
+// Redis, only printable ASCII without spaces is allowed.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+var clientSetNameHandler handler = func(sess *session, command *Command) (Reply, error) {
+	if !validClientName(command.Args[1]) {
+		return invalidClientNameError, nil
+	}
+	sess.name = command.Args[1]
+	return SimpleString("OK"), nil
+}
+
+var clientGetNameHandler handler = func(sess *session, command *Command) (Reply, error) {
+	if sess.name == "" {
+		return NullBulk, nil
+	}
+	return BulkString(sess.name), nil
+}
+
+var clientIDHandler handler = func(sess *session, command *Command) (Reply, error) {
+	return Integer(sess.id), nil
+}
+
+// clientSetInfoHandler accepts the library name and version that newer
+// clients send on connect. They aren't used by the proxy.
+var clientSetInfoHandler handler = func(sess *session, command *Command) (Reply, error) {
+	switch strings.ToUpper(command.Args[1]) {
+	case "LIB-NAME", "LIB-VER":
+		return SimpleString("OK"), nil
+	}
+	return Error("ERR Unrecognized option '" + command.Args[1] + "'"), nil
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eastside-eng/redis-proxy/cache"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSession() *session {
+	server := &Server{opt: &Options{}}
+	return server.newSession(bufio.NewWriter(&bytes.Buffer{}))
+}
+
+func TestHelloNegotiatesProtocol(t *testing.T) {
+	sess := newTestSession()
+
+	resp, err := helloHandler(sess, &Command{Name: "HELLO", Args: []string{"3", "SETNAME", "worker"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, sess.protocol)
+	assert.Equal(t, "worker", sess.name)
+
+	hello := resp.(Map)
+	assert.Equal(t, BulkString("proto"), hello[4])
+	assert.Equal(t, Integer(3), hello[5])
+
+	helloHandler(sess, &Command{Name: "HELLO", Args: []string{"2"}})
+	assert.Equal(t, 2, sess.protocol)
+	assert.Equal(t, "worker", sess.name)
+}
+
+func TestHelloErrors(t *testing.T) {
+	sess := newTestSession()
+
+	resp, _ := helloHandler(sess, &Command{Name: "HELLO", Args: []string{"4"}})
+	assert.Equal(t, Error("NOPROTO unsupported protocol version"), resp)
+
+	resp, _ = helloHandler(sess, &Command{Name: "HELLO", Args: []string{"three"}})
+	assert.Equal(t, Error("ERR Protocol version is not an integer or out of range"), resp)
+
+	resp, _ = helloHandler(sess, &Command{Name: "HELLO", Args: []string{"3", "SETNAME"}})
+	assert.Equal(t, Error("ERR Syntax error in HELLO option 'SETNAME'"), resp)
+	assert.Equal(t, 2, sess.protocol)
+}
+
+func TestPing(t *testing.T) {
+	sess := newTestSession()
+
+	resp, _ := pingHandler(sess, &Command{Name: "PING"})
+	assert.Equal(t, SimpleString("PONG"), resp)
+
+	resp, _ = pingHandler(sess, &Command{Name: "PING", Args: []string{"hi"}})
+	assert.Equal(t, BulkString("hi"), resp)
+}
+
+func TestCacheTTL(t *testing.T) {
+	ttl, ok := cacheTTL(-time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	ttl, ok = cacheTTL(1500 * time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, ttl)
+
+	_, ok = cacheTTL(-2 * time.Millisecond)
+	assert.False(t, ok)
+	_, ok = cacheTTL(0)
+	assert.False(t, ok)
+}
+
+func TestInfoHandler(t *testing.T) {
+	sess := newTestSession()
+	sess.server.cache = &cache.NoopCache{}
+	sess.server.flights = newFlightGroup()
+
+	resp, err := infoHandler(sess, &Command{Name: "INFO"})
+	assert.Nil(t, err)
+	text := resp.(Verbatim).Text
+	assert.Contains(t, text, "# Server\r\nredis_version:6.0.0\r\n")
+	assert.Contains(t, text, "# Stats\r\n")
+	assert.Contains(t, text, "coalesced_requests:0\r\n")
+
+	resp, _ = infoHandler(sess, &Command{Name: "INFO", Args: []string{"STATS"}})
+	assert.NotContains(t, resp.(Verbatim).Text, "# Server")
+
+	resp, _ = infoHandler(sess, &Command{Name: "INFO", Args: []string{"nosuchsection"}})
+	assert.Equal(t, "", resp.(Verbatim).Text)
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	lru, _ := cache.NewCache(&cache.Options{Capacity: 10, Period: time.Second, TTL: time.Minute, StaleGrace: time.Minute})
+	// Nothing listens on port 1, so every request fails to connect.
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1", MaxRetries: 0})
+	server := NewServer(lru, client, &Options{})
+
+	lru.Add("cached", "old", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	replies := server.fetchKeys([]string{"cached", "uncached"})
+	assert.Equal(t, BulkString("old"), replies[0])
+	_, isError := replies[1].(Error)
+	assert.True(t, isError)
+	assert.Equal(t, uint64(1), server.staleServed)
+
+	// The backend working and replying with an error isn't a failure.
+	_, ok := server.serveStale("cached", errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	assert.False(t, ok)
+}
+
+func TestNegativeCache(t *testing.T) {
+	values, _ := cache.NewCache(&cache.Options{Capacity: 10, Period: time.Second, TTL: time.Minute})
+	negative, _ := cache.NewCache(&cache.Options{Capacity: 10, Period: time.Second, TTL: time.Minute})
+	// There's no backend, so these must be answered from the caches.
+	server := NewServer(values, nil, &Options{NegativeCache: negative})
+	sess := server.newSession(bufio.NewWriter(&bytes.Buffer{}))
+
+	values.Add("present", "value", 0)
+	negative.Add("missing", true, 0)
+
+	resp, err := getHandler(sess, &Command{Name: "GET", Args: []string{"missing"}})
+	assert.Nil(t, err)
+	assert.Equal(t, NullBulk, resp)
+
+	resp, err = mgetHandler(sess, &Command{Name: "MGET", Args: []string{"present", "missing"}})
+	assert.Nil(t, err)
+	assert.Equal(t, Array{BulkString("value"), NullBulk}, resp)
+
+	resp, err = existsHandler(sess, &Command{Name: "EXISTS", Args: []string{"present", "missing", "present"}})
+	assert.Nil(t, err)
+	assert.Equal(t, Integer(2), resp)
+
+	// Writes through the proxy invalidate negative entries.
+	server.applyWrite(&Command{Name: "SET", Args: []string{"missing", "now"}}, SimpleString("OK"))
+	_, exists := negative.Get("missing")
+	assert.False(t, exists)
+	resp, _ = getHandler(sess, &Command{Name: "GET", Args: []string{"missing"}})
+	assert.Equal(t, BulkString("now"), resp)
+}
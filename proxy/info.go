@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// infoSections are the sections of INFO the proxy reports, in order, with the
+// function writing each one's fields.
+var infoSections = []struct {
+	name   string
+	fields func(s *Server, buf *bytes.Buffer)
+}{
+	{"server", (*Server).infoServer},
+	{"stats", (*Server).infoStats},
+	{"replication", (*Server).infoReplication},
+	{"cluster", (*Server).infoCluster},
+}
+
+// infoHandler implements INFO [section ...] for the proxy itself, in the
+// format Redis uses, so existing tooling can scrape it. With no sections, or
+// "all", "default" or "everything", every section is returned. Like Redis,
+// unknown sections are ignored.
+var infoHandler handler = func(sess *session, command *Command) (Reply, error) {
+	wanted := make(map[string]bool)
+	for _, arg := range command.Args {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	var buf bytes.Buffer
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		fmt.Fprintf(&buf, "# %s\r\n", strings.Title(section.name))
+		section.fields(sess.server, &buf)
+	}
+	return Verbatim{Format: "txt", Text: buf.String()}, nil
+}
+
+func (s *Server) infoServer(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "redis_version:%s\r\n", compatibleVersion)
+	if s.opt.SlotMap != nil {
+		fmt.Fprintf(buf, "redis_mode:cluster\r\n")
+	} else {
+		fmt.Fprintf(buf, "redis_mode:standalone\r\n")
+	}
+}
+
+func (s *Server) infoStats(buf *bytes.Buffer) {
+	stats := s.cache.Stats()
+	fmt.Fprintf(buf, "total_connections_received:%d\r\n", atomic.LoadInt64(&s.lastSessionID))
+	fmt.Fprintf(buf, "keyspace_hits:%d\r\n", stats.Hits)
+	fmt.Fprintf(buf, "keyspace_misses:%d\r\n", stats.Misses)
+	fmt.Fprintf(buf, "cache_keys:%d\r\n", stats.Len)
+	fmt.Fprintf(buf, "cache_bytes:%d\r\n", stats.Bytes)
+	fmt.Fprintf(buf, "coalesced_requests:%d\r\n", s.flights.Coalesced())
+	fmt.Fprintf(buf, "stale_refreshes:%d\r\n", atomic.LoadUint64(&s.refreshes))
+	fmt.Fprintf(buf, "stale_served:%d\r\n", atomic.LoadUint64(&s.staleServed))
+	fmt.Fprintf(buf, "backend_failovers:%d\r\n", atomic.LoadUint64(&s.failovers))
+}
+
+// infoReplication describes the proxy as a primary, with the replicas reads
+// are sent to, if any.
+func (s *Server) infoReplication(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "role:master\r\n")
+	if s.opt.Replicas != nil {
+		s.opt.Replicas.info(buf)
+	} else {
+		fmt.Fprintf(buf, "connected_slaves:0\r\n")
+	}
+}
+
+func (s *Server) infoCluster(buf *bytes.Buffer) {
+	if s.opt.SlotMap != nil {
+		fmt.Fprintf(buf, "cluster_enabled:1\r\n")
+	} else {
+		fmt.Fprintf(buf, "cluster_enabled:0\r\n")
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+
+	. "github.com/eastside-eng/redis-proxy/log"
+	"github.com/go-redis/redis"
+)
+
+// DefaultDeniedCommands are the commands refused in pass-through mode unless
+// configured otherwise. They either administer or wipe the backend, or block a
+// pooled backend connection for longer than its read timeout.
+var DefaultDeniedCommands = []string{
+	"ACL", "BGREWRITEAOF", "BGSAVE", "CONFIG|SET", "CONFIG|RESETSTAT",
+	"CONFIG|REWRITE", "DEBUG", "FAILOVER", "FLUSHALL",
+	"FLUSHDB", "KEYS", "MIGRATE", "MODULE", "REPLICAOF", "SAVE", "SHUTDOWN",
+	"SLAVEOF", "BLPOP", "BRPOP", "BRPOPLPUSH", "BLMOVE", "BZPOPMIN", "BZPOPMAX",
+	"XREAD", "XREADGROUP",
+}
+
+// statefulCommands can never be forwarded: they change the state of the
+// backend connection they run on, and backend connections are pooled and
+// shared by every client of the proxy.
+var statefulCommands = map[string]bool{
+	"AUTH": true, "CLIENT": true, "DISCARD": true, "EXEC": true,
+	"MONITOR": true, "MULTI": true, "PSUBSCRIBE": true, "PSYNC": true,
+	"PUNSUBSCRIBE": true, "QUIT": true, "READONLY": true, "READWRITE": true,
+	"RESET": true, "SELECT": true, "SSUBSCRIBE": true, "SUBSCRIBE": true,
+	"SUNSUBSCRIBE": true, "SYNC": true, "UNSUBSCRIBE": true, "UNWATCH": true,
+	"WAIT": true, "WATCH": true,
+}
+
+// statusCommands reply with a simple string, e.g. +OK, rather than a bulk
+// string. go-redis doesn't distinguish the two, so we need to know which to
+// send back. Subcommands are given by their full name, e.g. SCRIPT|FLUSH, as
+// others of the same container reply with bulk strings.
+var statusCommands = map[string]bool{
+	"CONFIG|RESETSTAT": true, "CONFIG|REWRITE": true, "CONFIG|SET": true,
+	"FLUSHALL": true, "FLUSHDB": true, "HMSET": true, "LSET": true,
+	"LTRIM": true, "MSET": true, "PFMERGE": true, "PSETEX": true,
+	"RENAME": true, "RESTORE": true, "SCRIPT|FLUSH": true, "SCRIPT|KILL": true,
+	"SET": true, "SETEX": true, "SWAPDB": true, "TYPE": true,
+	"XGROUP|CREATE": true, "XGROUP|SETID": true,
+}
+
+// repliesWithStatus reports whether the command replies with a simple string.
+func repliesWithStatus(command *Command) bool {
+	if command.Name == "SET" {
+		// With GET, SET replies with the key's old value instead of OK.
+		for i := 2; i < len(command.Args); i++ {
+			if strings.EqualFold(command.Args[i], "GET") {
+				return false
+			}
+		}
+	}
+	if statusCommands[command.Name] {
+		return true
+	}
+	return len(command.Args) > 0 && statusCommands[command.Name+"|"+strings.ToUpper(command.Args[0])]
+}
+
+// keyspaceCommands act on a whole keyspace, or describe the servers holding
+// it, so they can't be forwarded to a backend sharded across several servers:
+// they would only reach the one the client happens to pick, and CLUSTER SLOTS
+// would send clients around the proxy to the backend's nodes.
+var keyspaceCommands = map[string]bool{
+	"CLUSTER": true, "DBSIZE": true, "FLUSHALL": true, "FLUSHDB": true,
+	"KEYS": true, "RANDOMKEY": true, "SCAN": true, "SWAPDB": true,
+}
+
+// forwardable reports whether a command may be passed through to the
+// backend. name is the full name of the command, e.g. CONFIG|GET, and a
+// container being denied denies all of its subcommands.
+func (s *Server) forwardable(name string) bool {
+	container := strings.SplitN(name, "|", 2)[0]
+	if s.shardKey != nil && keyspaceCommands[container] {
+		return false
+	}
+	return !statefulCommands[container] && !s.denied[container] && !s.denied[name]
+}
+
+// forward sends a command to the backend verbatim and converts whatever it
+// replies with back into a Reply.
+func forward(redisClient redis.UniversalClient, command *Command) (Reply, error) {
+	cmd := newCmd(command)
+	redisClient.Process(cmd)
+	return forwardedReply(command, cmd)
+}
+
+// newCmd returns a go-redis command that sends the command verbatim.
+//
+// The name is sent in lower case. The sharded clients look commands up by
+// their lower case name, and go-redis lower cases any other through an unsafe
+// string conversion that the garbage collector can free from under it, which
+// garbles the name sent to the backend.
+func newCmd(command *Command) *redis.Cmd {
+	args := make([]interface{}, 0, len(command.Args)+1)
+	args = append(args, strings.ToLower(command.Name))
+	for _, arg := range command.Args {
+		args = append(args, arg)
+	}
+	return redis.NewCmd(args...)
+}
+
+// forwardedReply converts the result of a command sent with newCmd into a
+// Reply.
+func forwardedReply(command *Command, cmd *redis.Cmd) (Reply, error) {
+	val, err := cmd.Result()
+	Logger.Infow("Forwarded command to backing Redis", "command", command.Name, "err", err)
+	if err == redis.Nil {
+		return NullBulk, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if str, ok := val.(string); ok && repliesWithStatus(command) && !strings.ContainsAny(str, "\r\n") {
+		return SimpleString(str), nil
+	}
+	return toReply(val), nil
+}
+
+// toReply converts a value parsed by go-redis into a Reply.
+func toReply(val interface{}) Reply {
+	switch val := val.(type) {
+	case nil:
+		return NullBulk
+	case string:
+		return BulkString(val)
+	case int64:
+		return Integer(val)
+	case []interface{}:
+		elements := make(Array, len(val))
+		for i, element := range val {
+			elements[i] = toReply(element)
+		}
+		return elements
+	case error:
+		return errorReply(val)
+	}
+	return unexpectedReplyError
+}
+
+// unexpectedReplyError is the reply to a command the backend answered with a
+// reply of a kind that it never sends for it.
+var unexpectedReplyError = Error("ERR unexpected reply from backend")
+
+// resp3Replies convert the replies of forwarded commands, which go-redis only
+// parses in their RESP2 shapes, into the types Redis sends RESP3 clients. They
+// are keyed by the command's full name and leave replies of any other shape,
+// e.g. errors, alone.
+var resp3Replies = map[string]func(command *Command, resp Reply) Reply{
+	"CONFIG|GET": toMap, "HGETALL": toMap,
+	"SDIFF": toSet, "SINTER": toSet, "SMEMBERS": toSet, "SUNION": toSet,
+	"ZINCRBY": toDouble, "ZSCORE": toDouble, "ZMSCORE": toDoubles,
+	"ZRANGE": withScores, "ZRANGEBYSCORE": withScores, "ZREVRANGE": withScores,
+	"ZREVRANGEBYSCORE": withScores,
+}
+
+// resp3Reply returns the reply Redis would send a RESP3 client for the
+// forwarded command name.
+func resp3Reply(name string, command *Command, resp Reply) Reply {
+	if convert, exists := resp3Replies[name]; exists {
+		return convert(command, resp)
+	}
+	return resp
+}
+
+func toMap(command *Command, resp Reply) Reply {
+	if elements, ok := resp.(Array); ok && len(elements)%2 == 0 {
+		return Map(elements)
+	}
+	return resp
+}
+
+func toSet(command *Command, resp Reply) Reply {
+	if elements, ok := resp.(Array); ok {
+		return Set(elements)
+	}
+	return resp
+}
+
+func toDouble(command *Command, resp Reply) Reply {
+	if str, ok := resp.(BulkString); ok {
+		if f, err := strconv.ParseFloat(string(str), 64); err == nil {
+			return Double(f)
+		}
+	}
+	return resp
+}
+
+func toDoubles(command *Command, resp Reply) Reply {
+	elements, ok := resp.(Array)
+	if !ok {
+		return resp
+	}
+	doubles := make(Array, len(elements))
+	for i, element := range elements {
+		doubles[i] = toDouble(command, element)
+	}
+	return doubles
+}
+
+// withScores turns the flat member, score, member... reply of a sorted set
+// range WITHSCORES into the pairs of member and Double sent to RESP3 clients.
+func withScores(command *Command, resp Reply) Reply {
+	elements, ok := resp.(Array)
+	if !ok || len(elements)%2 != 0 {
+		return resp
+	}
+	scored := false
+	for _, arg := range command.Args {
+		if strings.EqualFold(arg, "WITHSCORES") {
+			scored = true
+		}
+	}
+	if !scored {
+		return resp
+	}
+	pairs := make(Array, 0, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		pairs = append(pairs, Array{elements[i], toDouble(command, elements[i+1])})
+	}
+	return pairs
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/eastside-eng/redis-proxy/cache"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToReply(t *testing.T) {
+	assert.Equal(t, BulkString("foo"), toReply("foo"))
+	assert.Equal(t, Integer(3), toReply(int64(3)))
+	assert.Equal(t, NullBulk, toReply(nil))
+	assert.Equal(t, Array{BulkString("a"), NullBulk, Array{Integer(1)}},
+		toReply([]interface{}{"a", nil, []interface{}{int64(1)}}))
+	assert.Equal(t, Error("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		toReply(errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")))
+}
+
+func TestForwardable(t *testing.T) {
+	opt := &Options{Passthrough: true, DeniedCommands: []string{"flushall"}}
+	server := NewServer(nil, nil, opt)
+
+	assert.True(t, server.forwardable("HGET"))
+	assert.False(t, server.forwardable("FLUSHALL"))
+	assert.False(t, server.forwardable("MULTI"))
+	assert.True(t, server.forwardable("KEYS"))
+	assert.False(t, server.forwardable("CLIENT|LIST"))
+
+	resp := server.processCommand(newTestSession(), &Command{Name: "FLUSHALL"})
+	assert.Equal(t, Error("ERR command 'flushall' is not allowed through the proxy"), resp)
+}
+
+func TestForwardedWritesNeedPassthrough(t *testing.T) {
+	backend := newFakeRedis(t, map[string]string{"EVAL": ":1\r\n", "SETBIT": ":0\r\n"})
+	defer backend.close()
+	client := redis.NewClient(&redis.Options{Addr: backend.addr()})
+	server := NewServer(&cache.NoopCache{}, client, &Options{})
+	sess := server.newSession(bufio.NewWriter(&bytes.Buffer{}))
+
+	resp := server.processCommand(sess, &Command{Name: "EVAL", Args: []string{"return 1", "0"}})
+	assert.Equal(t, Error("ERR unknown command 'EVAL', with args beginning with: 'return 1' '0' "), resp)
+	resp = server.processCommand(sess, &Command{Name: "SETBIT", Args: []string{"k", "1", "1"}})
+	_, isError := resp.(Error)
+	assert.True(t, isError)
+	assert.Nil(t, backend.received())
+
+	server.opt.Passthrough = true
+	assert.Equal(t, Integer(1), server.processCommand(sess, &Command{Name: "EVAL", Args: []string{"return 1", "0"}}))
+	assert.Equal(t, []string{"EVAL return 1 0"}, backend.received())
+}
+
+func TestForwardableSharded(t *testing.T) {
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"localhost:1"}})
+	defer client.Close()
+	server := NewServer(nil, client, &Options{Passthrough: true})
+
+	assert.False(t, server.forwardable("SCAN"))
+	assert.False(t, server.forwardable("DBSIZE"))
+	assert.False(t, server.forwardable("CLUSTER|SLOTS"))
+	assert.True(t, server.forwardable("HGET"))
+
+	resp := server.processCommand(newTestSession(), &Command{Name: "CLUSTER", Args: []string{"SLOTS"}})
+	assert.Equal(t, Error("ERR command 'cluster|slots' is not allowed through the proxy"), resp)
+}
+
+func TestDefaultDeniedCommands(t *testing.T) {
+	server := NewServer(nil, nil, &Options{Passthrough: true})
+	assert.False(t, server.forwardable("KEYS"))
+	assert.False(t, server.forwardable("SHUTDOWN"))
+	assert.False(t, server.forwardable("CONFIG|SET"))
+	assert.True(t, server.forwardable("CONFIG|GET"))
+}
+
+func TestResp3Replies(t *testing.T) {
+	backend := newFakeRedis(t, map[string]string{
+		"HGETALL":  "*4\r\n$1\r\nf\r\n$1\r\nv\r\n$1\r\ng\r\n$1\r\nw\r\n",
+		"CONFIG":   "*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n",
+		"SMEMBERS": "*2\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"ZSCORE":   "$3\r\n1.5\r\n",
+		"ZMSCORE":  "*2\r\n$3\r\ninf\r\n$-1\r\n",
+		"ZRANGE":   "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$3\r\n2.5\r\n",
+	})
+	defer backend.close()
+	client := redis.NewClient(&redis.Options{Addr: backend.addr()})
+	server := NewServer(&cache.NoopCache{}, client, &Options{Passthrough: true})
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	sess := server.newSession(writer)
+
+	// RESP2 sessions get replies as the backend sent them.
+	resp := server.processCommand(sess, &Command{Name: "HGETALL", Args: []string{"h"}})
+	assert.Equal(t, Array{BulkString("f"), BulkString("v"), BulkString("g"), BulkString("w")}, resp)
+
+	sess.setProtocol(3)
+	resp = server.processCommand(sess, &Command{Name: "HGETALL", Args: []string{"h"}})
+	assert.Equal(t, Map{BulkString("f"), BulkString("v"), BulkString("g"), BulkString("w")}, resp)
+	resp = server.processCommand(sess, &Command{Name: "CONFIG", Args: []string{"GET", "maxmemory"}})
+	assert.Equal(t, Map{BulkString("maxmemory"), BulkString("0")}, resp)
+	resp = server.processCommand(sess, &Command{Name: "SMEMBERS", Args: []string{"s"}})
+	assert.Equal(t, Set{BulkString("a"), BulkString("b")}, resp)
+	resp = server.processCommand(sess, &Command{Name: "ZSCORE", Args: []string{"z", "a"}})
+	assert.Equal(t, Double(1.5), resp)
+	resp = server.processCommand(sess, &Command{Name: "ZMSCORE", Args: []string{"z", "a", "x"}})
+	assert.Equal(t, Array{Double(math.Inf(1)), NullBulk}, resp)
+	resp = server.processCommand(sess, &Command{Name: "ZRANGE", Args: []string{"z", "0", "-1", "withscores"}})
+	assert.Equal(t, Array{Array{BulkString("a"), Double(1)}, Array{BulkString("b"), Double(2.5)}}, resp)
+
+	sess.encoder.Encode(server.processCommand(sess, &Command{Name: "SMEMBERS", Args: []string{"s"}}))
+	writer.Flush()
+	assert.Equal(t, "~2\r\n$1\r\na\r\n$1\r\nb\r\n", buf.String())
+}
+
+func TestRepliesWithStatus(t *testing.T) {
+	assert.True(t, repliesWithStatus(&Command{Name: "SET", Args: []string{"k", "v", "EX", "10"}}))
+	assert.False(t, repliesWithStatus(&Command{Name: "SET", Args: []string{"k", "v", "get"}}))
+	// A value of GET isn't the option.
+	assert.True(t, repliesWithStatus(&Command{Name: "SET", Args: []string{"k", "GET"}}))
+	assert.True(t, repliesWithStatus(&Command{Name: "SCRIPT", Args: []string{"flush"}}))
+	assert.False(t, repliesWithStatus(&Command{Name: "SCRIPT", Args: []string{"LOAD", "return 1"}}))
+	assert.False(t, repliesWithStatus(&Command{Name: "GET", Args: []string{"k"}}))
+}
+
+func TestForwardBulkReplies(t *testing.T) {
+	sha := "e0e1f9fabfc9d4800c877a703b823ac0578ff8db"
+	backend := newFakeRedis(t, map[string]string{
+		"SET":    "$3\r\nold\r\n",
+		"SCRIPT": "$40\r\n" + sha + "\r\n",
+	})
+	defer backend.close()
+	client := redis.NewClient(&redis.Options{Addr: backend.addr()})
+
+	resp, err := forward(client, &Command{Name: "SET", Args: []string{"k", "v", "GET"}})
+	assert.Nil(t, err)
+	assert.Equal(t, BulkString("old"), resp)
+
+	resp, err = forward(client, &Command{Name: "SCRIPT", Args: []string{"LOAD", "return 1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, BulkString(sha), resp)
+}
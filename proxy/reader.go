@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxBulkLength mirrors the proto-max-bulk-len default of Redis, 512 MB.
+const DefaultMaxBulkLength = 512 * 1024 * 1024
+
+// maxMultiBulkLength is the largest number of items accepted in one command,
+// matching the limit Redis applies.
+const maxMultiBulkLength = 1024 * 1024
+
+// maxInlineLength is the longest inline command accepted, matching Redis.
+const maxInlineLength = 64 * 1024
+
+// ProtocolError is returned by Reader when the incoming bytes are not valid
+// RESP. The stream cannot be resynchronised after one, so the connection
+// should be closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func protocolErrorf(format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{fmt.Sprintf(format, args...)}
+}
+
+// Reader incrementally decodes RESP commands from a stream. It buffers
+// internally, so commands may arrive split over any number of reads, or
+// several commands may arrive in a single read.
+//
+// Both multibulk commands, as sent by client libraries, and inline commands,
+// as typed into telnet or netcat, are understood.
+type Reader struct {
+	rd            *bufio.Reader
+	maxBulkLength int
+}
+
+// NewReader returns a Reader that decodes commands from rd, rejecting bulk
+// strings longer than maxBulkLength bytes.
+func NewReader(rd io.Reader, maxBulkLength int) *Reader {
+	return &Reader{
+		rd:            bufio.NewReader(rd),
+		maxBulkLength: maxBulkLength,
+	}
+}
+
+// ReadCommand blocks until a whole command has been read and returns it.
+// io.EOF is returned if the stream ends cleanly between commands,
+// io.ErrUnexpectedEOF if it ends part way through one and a *ProtocolError
+// if the input is malformed.
+func (r *Reader) ReadCommand() (*Command, error) {
+	for {
+		prefix, err := r.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if prefix[0] != '*' {
+			items, err := r.readInline()
+			if err != nil {
+				return nil, err
+			}
+			// Like Redis, blank lines are skipped.
+			if len(items) == 0 {
+				continue
+			}
+			return &Command{Name: strings.ToUpper(items[0]), Args: items[1:]}, nil
+		}
+
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		numItems, err := strconv.Atoi(string(line[1:]))
+		if err != nil || numItems > maxMultiBulkLength {
+			return nil, protocolErrorf("invalid multibulk length")
+		}
+		// Redis silently ignores empty multibulk requests.
+		if numItems <= 0 {
+			continue
+		}
+
+		items := make([]string, numItems)
+		for i := range items {
+			items[i], err = r.readBulkString()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		}
+		return &Command{Name: strings.ToUpper(items[0]), Args: items[1:]}, nil
+	}
+}
+
+// Buffered returns the number of bytes that have been received but not yet
+// decoded.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// readBulkString reads a single '$' prefixed bulk string.
+func (r *Reader) readBulkString() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", protocolErrorf("expected '$', got '%s'", firstByte(line))
+	}
+
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length < 0 || length > r.maxBulkLength {
+		return "", protocolErrorf("invalid bulk length")
+	}
+
+	// The payload is copied in as it arrives rather than allocated up front,
+	// so a client can't make us reserve maxBulkLength bytes with a header.
+	var payload strings.Builder
+	if _, err := io.CopyN(&payload, r.rd, int64(length)); err != nil {
+		return "", err
+	}
+	if err := r.readCRLF(); err != nil {
+		return "", err
+	}
+	return payload.String(), nil
+}
+
+// readInline reads a single line and splits it into arguments. Unlike the
+// multibulk format the line may end with a bare LF.
+func (r *Reader) readInline() ([]string, error) {
+	var line []byte
+	for {
+		fragment, err := r.rd.ReadSlice('\n')
+		if len(line)+len(fragment) > maxInlineLength {
+			return nil, protocolErrorf("too big inline request")
+		}
+		line = append(line, fragment...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, unexpectedEOF(err)
+		}
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return splitArgs(string(line))
+}
+
+// splitArgs splits an inline command into arguments using the same rules as
+// redis-cli and the Redis server: arguments are separated by whitespace and
+// may be quoted. Double quoted arguments support the escapes \n, \r, \t, \b,
+// \a and \xHH, while single quoted arguments only support \'.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if inDouble {
+				if i == len(line) {
+					return nil, protocolErrorf("unbalanced quotes in request")
+				}
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' &&
+					isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, unescape(line[i]))
+				case line[i] == '"':
+					// The closing quote must be followed by a space or nothing.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolErrorf("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else if inSingle {
+				if i == len(line) {
+					return nil, protocolErrorf("unbalanced quotes in request")
+				}
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolErrorf("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else {
+				switch {
+				case i == len(line) || isSpace(line[i]):
+					done = true
+				case line[i] == '"':
+					inDouble = true
+				case line[i] == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// unescape returns the byte represented by a backslash escape in a double
+// quoted inline argument.
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
+
+// readLine reads up to the next CRLF and returns the line without it. The
+// returned slice is only valid until the next read.
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Headers are short decimal numbers, anything that doesn't fit in the
+		// buffer is garbage.
+		return nil, protocolErrorf("too big count string")
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, protocolErrorf("invalid line terminator")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (r *Reader) readCRLF() error {
+	cr, err := r.rd.ReadByte()
+	if err != nil {
+		return err
+	}
+	lf, err := r.rd.ReadByte()
+	if err != nil {
+		return err
+	}
+	if cr != '\r' || lf != '\n' {
+		return protocolErrorf("expected CRLF after bulk string")
+	}
+	return nil
+}
+
+// unexpectedEOF converts a clean EOF part way through a command into
+// io.ErrUnexpectedEOF so callers can tell truncation from a closed connection.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func firstByte(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	return string(line[:1])
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderSplitReads(t *testing.T) {
+	raw := []byte("*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$8\r\nmy value\r\n")
+	reader := NewReader(iotest.OneByteReader(bytes.NewReader(raw)), DefaultMaxBulkLength)
+
+	out, err := reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "SET", out.Name)
+	assert.Equal(t, []string{"mykey", "my value"}, out.Args)
+
+	_, err = reader.ReadCommand()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderMultipleCommands(t *testing.T) {
+	raw := []byte("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nx\r\n")
+	reader := NewReader(bytes.NewReader(raw), DefaultMaxBulkLength)
+
+	out, err := reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "PING", out.Name)
+	assert.True(t, reader.Buffered() > 0)
+
+	out, err = reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "GET", out.Name)
+	assert.Equal(t, "x", out.Args[0])
+	assert.Equal(t, 0, reader.Buffered())
+}
+
+func TestReaderLargeBulkString(t *testing.T) {
+	value := strings.Repeat("x", 200*1024)
+	raw := []byte("*2\r\n$4\r\nECHO\r\n$204800\r\n" + value + "\r\n")
+	reader := NewReader(bytes.NewReader(raw), DefaultMaxBulkLength)
+
+	out, err := reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, value, out.Args[0])
+}
+
+func TestReaderMaxBulkLength(t *testing.T) {
+	raw := []byte("*2\r\n$4\r\nECHO\r\n$11\r\nhello world\r\n")
+	reader := NewReader(bytes.NewReader(raw), 10)
+
+	out, err := reader.ReadCommand()
+	assert.Nil(t, out)
+	assert.Equal(t, "Protocol error: invalid bulk length", err.Error())
+}
+
+func TestReaderProtocolErrors(t *testing.T) {
+	cases := map[string]string{
+		"*x\r\n":             "Protocol error: invalid multibulk length",
+		"*1\r\n:4\r\n":       "Protocol error: expected '$', got ':'",
+		"*1\r\n$-5\r\n":      "Protocol error: invalid bulk length",
+		"*1\r\n$4\r\nPINGxx": "Protocol error: expected CRLF after bulk string",
+		"*1\n":               "Protocol error: invalid line terminator",
+		"GET \"foo\r\n":      "Protocol error: unbalanced quotes in request",
+	}
+	for raw, msg := range cases {
+		reader := NewReader(strings.NewReader(raw), DefaultMaxBulkLength)
+		var err error
+		for err == nil {
+			_, err = reader.ReadCommand()
+		}
+		_, ok := err.(*ProtocolError)
+		assert.True(t, ok, raw)
+		assert.Equal(t, msg, err.Error(), raw)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	reader := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nfo"), DefaultMaxBulkLength)
+	_, err := reader.ReadCommand()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderSkipsEmptyMultiBulk(t *testing.T) {
+	reader := NewReader(strings.NewReader("*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n"), DefaultMaxBulkLength)
+	out, err := reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "PING", out.Name)
+}
+
+func TestReaderInline(t *testing.T) {
+	reader := NewReader(strings.NewReader("PING\r\n\r\nget foo\n*1\r\n$4\r\nPING\r\n"), DefaultMaxBulkLength)
+
+	out, err := reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "PING", out.Name)
+	assert.Equal(t, 0, len(out.Args))
+
+	out, err = reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "GET", out.Name)
+	assert.Equal(t, []string{"foo"}, out.Args)
+
+	out, err = reader.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "PING", out.Name)
+}
+
+func TestReaderInlineTooBig(t *testing.T) {
+	raw := "SET foo " + strings.Repeat("x", maxInlineLength) + "\r\n"
+	reader := NewReader(strings.NewReader(raw), DefaultMaxBulkLength)
+	_, err := reader.ReadCommand()
+	assert.Equal(t, "Protocol error: too big inline request", err.Error())
+}
+
+func TestSplitArgs(t *testing.T) {
+	cases := map[string][]string{
+		"set key value":        {"set", "key", "value"},
+		"  set   key\tvalue  ": {"set", "key", "value"},
+		`set key "my value"`:   {"set", "key", "my value"},
+		`set key "a\"b\n\x41"`: {"set", "key", "a\"b\nA"},
+		`set key 'it\'s \n'`:   {"set", "key", "it's \\n"},
+		`set key ""`:           {"set", "key", ""},
+		`set k"e" v`:           {"set", "ke", "v"},
+		"":                     nil,
+	}
+	for line, expected := range cases {
+		args, err := splitArgs(line)
+		assert.Nil(t, err, line)
+		assert.Equal(t, expected, args, line)
+	}
+
+	for _, line := range []string{`get k"e"y`, `get "foo`, `get 'foo`, `get "foo"bar`, `get 'foo'bar`} {
+		_, err := splitArgs(line)
+		assert.Equal(t, "Protocol error: unbalanced quotes in request", err.Error(), line)
+	}
+}
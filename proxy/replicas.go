@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/eastside-eng/redis-proxy/log"
+	"github.com/go-redis/redis"
+)
+
+// The ways a ReplicaSet can choose the replica a read goes to.
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLatency    = "latency"
+)
+
+// ReplicaOptions configures a ReplicaSet.
+type ReplicaOptions struct {
+	// How reads are spread over the replicas, BalanceRoundRobin or
+	// BalanceLatency.
+	// Default is BalanceRoundRobin.
+	Balance string
+	// How far behind the primary a replica may be and still be read from.
+	// Default is 1 second.
+	MaxLag time.Duration
+	// How often the replication state of the primary and replicas is checked.
+	// Default is 500 milliseconds.
+	CheckPeriod time.Duration
+}
+
+func (opt *ReplicaOptions) init() {
+	if opt.Balance == "" {
+		opt.Balance = BalanceRoundRobin
+	}
+	if opt.MaxLag <= 0 {
+		opt.MaxLag = time.Second
+	}
+	if opt.CheckPeriod <= 0 {
+		opt.CheckPeriod = 500 * time.Millisecond
+	}
+}
+
+// replica is a read-only copy of the primary, and what was last found out
+// about it.
+type replica struct {
+	client *redis.Client
+	// Whether the replica is in the read set. Updated by check.
+	healthy bool
+	// How far behind the primary the replica is, at most, and a moving
+	// average of the time it takes to answer.
+	lag     time.Duration
+	latency time.Duration
+}
+
+// offsetSample is the replication offset of the primary at some time.
+type offsetSample struct {
+	at     time.Time
+	offset int64
+}
+
+// ReplicaSet sends reads to replicas of the primary, so that cache misses
+// don't all land on it. Writes, and reads of keys just written through the
+// proxy, still go to the primary.
+//
+// Replicas are checked every CheckPeriod with INFO replication. One is only
+// read from while its link to the primary is up and it's no more than MaxLag
+// behind. The lag is estimated from the primary's replication offsets: a
+// replica that has reached the offset the primary had at some time holds
+// every write made before it, so it's behind by no more than the time since.
+type ReplicaSet struct {
+	// The number of reads sent to replicas, and a round-robin counter.
+	// Accessed atomically, kept first for 64 bit alignment.
+	reads uint64
+	next  uint64
+
+	primary  redis.UniversalClient
+	replicas []*replica
+	opt      *ReplicaOptions
+
+	lock sync.RWMutex
+	// The replicas reads may go to.
+	readable []*replica
+	// Recent offsets of the primary, oldest first.
+	samples []offsetSample
+
+	// The keys written recently, with when they may be read from replicas
+	// again.
+	fenceLock sync.Mutex
+	fences    map[string]time.Time
+	// Until when every read goes to the primary, see fenceAll.
+	fencedUntil time.Time
+
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+// NewReplicaSet returns a ReplicaSet of the replicas of primary. No reads go
+// to the replicas until they've been checked, see Start.
+func NewReplicaSet(primary redis.UniversalClient, replicas []*redis.Client, opt *ReplicaOptions) (*ReplicaSet, error) {
+	opt.init()
+	if opt.Balance != BalanceRoundRobin && opt.Balance != BalanceLatency {
+		return nil, fmt.Errorf("Unknown replica balancing '%s'", opt.Balance)
+	}
+
+	set := &ReplicaSet{
+		primary: primary,
+		opt:     opt,
+		fences:  make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}
+	for _, client := range replicas {
+		set.replicas = append(set.replicas, &replica{client: client})
+	}
+	return set, nil
+}
+
+// reader returns the client a read of the keys should go to: a replica, or
+// the primary if none is healthy or one of the keys was written too recently
+// for the replicas to have caught up.
+func (set *ReplicaSet) reader(keys []string) redis.UniversalClient {
+	if set.fenced(keys) {
+		return set.primary
+	}
+
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+
+	if len(set.readable) == 0 {
+		return set.primary
+	}
+	chosen := set.readable[0]
+	if set.opt.Balance == BalanceLatency {
+		for _, r := range set.readable[1:] {
+			if r.latency < chosen.latency {
+				chosen = r
+			}
+		}
+	} else {
+		next := atomic.AddUint64(&set.next, 1)
+		chosen = set.readable[next%uint64(len(set.readable))]
+	}
+	atomic.AddUint64(&set.reads, 1)
+	return chosen.client
+}
+
+// fence sends reads of the keys to the primary for as long as a replica in
+// the read set could still be missing a write made to them now.
+func (set *ReplicaSet) fence(keys []string) {
+	until := time.Now().Add(set.opt.MaxLag + set.opt.CheckPeriod)
+
+	set.fenceLock.Lock()
+	defer set.fenceLock.Unlock()
+
+	for _, key := range keys {
+		set.fences[key] = until
+	}
+}
+
+// fenceAll sends every read to the primary for as long as fence would, after
+// a write to keys that aren't known.
+func (set *ReplicaSet) fenceAll() {
+	until := time.Now().Add(set.opt.MaxLag + set.opt.CheckPeriod)
+
+	set.fenceLock.Lock()
+	defer set.fenceLock.Unlock()
+
+	set.fencedUntil = until
+}
+
+func (set *ReplicaSet) fenced(keys []string) bool {
+	set.fenceLock.Lock()
+	defer set.fenceLock.Unlock()
+
+	now := time.Now()
+	if now.Before(set.fencedUntil) {
+		return true
+	}
+	for _, key := range keys {
+		if until, exists := set.fences[key]; exists && now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// check updates the replication state of the replicas and the read set, and
+// drops the fences that are no longer needed.
+func (set *ReplicaSet) check() {
+	now := time.Now()
+	info, err := set.primary.Info("replication").Result()
+	if err == nil {
+		offset, _ := strconv.ParseInt(infoField(info, "master_repl_offset"), 10, 64)
+		set.sample(offsetSample{now, offset})
+	} else {
+		Logger.Warnw("Failed to check primary replication", "err", err)
+	}
+
+	for _, r := range set.replicas {
+		start := time.Now()
+		info, err := r.client.Info("replication").Result()
+		latency := time.Since(start)
+
+		set.lock.Lock()
+		if err != nil {
+			Logger.Warnw("Failed to check replica", "replica", r.client.Options().Addr, "err", err)
+			r.healthy = false
+		} else {
+			offset, _ := strconv.ParseInt(infoField(info, "slave_repl_offset"), 10, 64)
+			r.lag = set.lagOf(offset, time.Now())
+			r.healthy = infoField(info, "master_link_status") == "up" && r.lag <= set.opt.MaxLag
+			if r.latency == 0 {
+				r.latency = latency
+			} else {
+				r.latency = (7*r.latency + latency) / 8
+			}
+		}
+		set.lock.Unlock()
+	}
+
+	set.lock.Lock()
+	set.readable = set.readable[:0]
+	for _, r := range set.replicas {
+		if r.healthy {
+			set.readable = append(set.readable, r)
+		}
+	}
+	set.lock.Unlock()
+
+	set.fenceLock.Lock()
+	for key, until := range set.fences {
+		if !now.Before(until) {
+			delete(set.fences, key)
+		}
+	}
+	set.fenceLock.Unlock()
+}
+
+// sample records an offset of the primary, keeping as many as are needed to
+// tell whether a replica is within MaxLag.
+func (set *ReplicaSet) sample(s offsetSample) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	set.samples = append(set.samples, s)
+	horizon := s.at.Add(-set.opt.MaxLag - 2*set.opt.CheckPeriod)
+	for len(set.samples) > 1 && set.samples[1].at.Before(horizon) {
+		set.samples = set.samples[1:]
+	}
+}
+
+// lagOf returns how far behind the primary a replica at the given offset is,
+// at most. A replica behind every sample is reported as behind by more than
+// MaxLag. Called with the lock held.
+func (set *ReplicaSet) lagOf(offset int64, now time.Time) time.Duration {
+	if len(set.samples) == 0 {
+		// The primary hasn't been reached, so nothing is known.
+		return set.opt.MaxLag + 1
+	}
+	for i := len(set.samples) - 1; i >= 0; i-- {
+		if set.samples[i].offset <= offset {
+			if i == len(set.samples)-1 {
+				return 0
+			}
+			return now.Sub(set.samples[i].at)
+		}
+	}
+	return now.Sub(set.samples[0].at) + set.opt.MaxLag + 1
+}
+
+// Reads returns the number of reads sent to replicas.
+func (set *ReplicaSet) Reads() uint64 {
+	return atomic.LoadUint64(&set.reads)
+}
+
+// info writes the state of each replica in the format of INFO replication.
+func (set *ReplicaSet) info(buf *bytes.Buffer) {
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+
+	fmt.Fprintf(buf, "connected_slaves:%d\r\n", len(set.readable))
+	for i, r := range set.replicas {
+		healthy := 0
+		if r.healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(buf, "slave%d:addr=%s,healthy=%d,lag_ms=%d,latency_us=%d\r\n",
+			i, r.client.Options().Addr, healthy, r.lag/time.Millisecond, r.latency/time.Microsecond)
+	}
+	fmt.Fprintf(buf, "replica_reads:%d\r\n", set.Reads())
+}
+
+// Start checks the replicas, and keeps checking them every CheckPeriod until
+// Stop is called.
+func (set *ReplicaSet) Start() {
+	set.check()
+	set.ticker = time.NewTicker(set.opt.CheckPeriod)
+	go func() {
+		for {
+			select {
+			case <-set.ticker.C:
+				set.check()
+			case <-set.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops checking the replicas.
+func (set *ReplicaSet) Stop() {
+	set.ticker.Stop()
+	close(set.done)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/eastside-eng/redis-proxy/cache"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReplicaSet(t *testing.T, balance string) (*ReplicaSet, *redis.Client, []*redis.Client) {
+	primary := redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	replicas := []*redis.Client{
+		redis.NewClient(&redis.Options{Addr: "localhost:2"}),
+		redis.NewClient(&redis.Options{Addr: "localhost:3"}),
+	}
+	set, err := NewReplicaSet(primary, replicas, &ReplicaOptions{Balance: balance, MaxLag: time.Second, CheckPeriod: time.Second})
+	assert.Nil(t, err)
+	return set, primary, replicas
+}
+
+func TestReplicaSetReader(t *testing.T) {
+	set, primary, replicas := newTestReplicaSet(t, BalanceRoundRobin)
+	// Nothing is read from replicas until they're known to be healthy.
+	assert.Equal(t, primary, set.reader([]string{"a"}))
+
+	set.readable = set.replicas
+	first := set.reader([]string{"a"})
+	second := set.reader([]string{"a"})
+	assert.NotEqual(t, primary, first)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, first, set.reader([]string{"a"}))
+	assert.Equal(t, uint64(3), set.Reads())
+
+	// Keys just written are read from the primary, with any others.
+	set.fence([]string{"b"})
+	assert.Equal(t, primary, set.reader([]string{"a", "b"}))
+	assert.NotEqual(t, primary, set.reader([]string{"a"}))
+
+	set, _, replicas = newTestReplicaSet(t, BalanceLatency)
+	set.readable = set.replicas
+	set.replicas[0].latency = 2 * time.Millisecond
+	set.replicas[1].latency = time.Millisecond
+	assert.Equal(t, replicas[1], set.reader(nil))
+	assert.Equal(t, replicas[1], set.reader(nil))
+
+	_, err := NewReplicaSet(primary, replicas, &ReplicaOptions{Balance: "random"})
+	assert.NotNil(t, err)
+}
+
+func TestReplicaSetLag(t *testing.T) {
+	set, _, _ := newTestReplicaSet(t, BalanceRoundRobin)
+	now := time.Now()
+	assert.True(t, set.lagOf(0, now) > set.opt.MaxLag)
+
+	set.sample(offsetSample{now.Add(-3 * time.Second), 100})
+	set.sample(offsetSample{now.Add(-2 * time.Second), 200})
+	set.sample(offsetSample{now.Add(-time.Second), 300})
+	set.sample(offsetSample{now, 400})
+	set.sample(offsetSample{now.Add(time.Second), 500})
+	assert.Equal(t, 5, len(set.samples))
+	// Only the samples needed to measure MaxLag plus two periods are kept.
+	set.sample(offsetSample{now.Add(2 * time.Second), 600})
+	assert.Equal(t, 5, len(set.samples))
+	assert.Equal(t, int64(200), set.samples[0].offset)
+
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, time.Duration(0), set.lagOf(600, now))
+	assert.Equal(t, time.Duration(0), set.lagOf(700, now))
+	assert.Equal(t, time.Second, set.lagOf(500, now))
+	assert.Equal(t, 2*time.Second, set.lagOf(450, now))
+	assert.Equal(t, 4*time.Second, set.lagOf(200, now))
+	assert.True(t, set.lagOf(100, now) > set.opt.MaxLag)
+}
+
+func TestClientFor(t *testing.T) {
+	set, primary, _ := newTestReplicaSet(t, BalanceRoundRobin)
+	set.readable = set.replicas
+	server := NewServer(&cache.NoopCache{}, primary, &Options{Replicas: set})
+
+	assert.NotEqual(t, primary, server.clientFor(&Command{Name: "HGET", Args: []string{"h", "f"}}))
+	assert.NotEqual(t, primary, server.reader([]string{"a"}))
+	assert.Equal(t, primary, server.clientFor(&Command{Name: "GETDEL", Args: []string{"a"}}))
+	assert.Equal(t, primary, server.clientFor(&Command{Name: "SET", Args: []string{"a", "1"}}))
+	assert.Equal(t, primary, server.clientFor(&Command{Name: "HSET", Args: []string{"h", "f", "v"}}))
+}
+
+func TestReadYourWrites(t *testing.T) {
+	backend := newFakeRedis(t, map[string]string{"HSET": ":1\r\n", "HGET": "$1\r\nv\r\n"})
+	defer backend.close()
+	primary := redis.NewClient(&redis.Options{Addr: backend.addr()})
+	// Nothing listens on the replicas' ports, so reads sent to them fail.
+	set, err := NewReplicaSet(primary, []*redis.Client{
+		redis.NewClient(&redis.Options{Addr: "localhost:2"}),
+	}, &ReplicaOptions{MaxLag: time.Second, CheckPeriod: time.Second})
+	assert.Nil(t, err)
+	set.readable = set.replicas
+	server := NewServer(&cache.NoopCache{}, primary, &Options{Passthrough: true, Replicas: set})
+	sess := server.newSession(bufio.NewWriter(&bytes.Buffer{}))
+
+	assert.NotEqual(t, primary, server.clientFor(&Command{Name: "HGET", Args: []string{"h", "f"}}))
+	assert.Equal(t, Integer(1), server.processCommand(sess, &Command{Name: "HSET", Args: []string{"h", "f", "v"}}))
+	// The write fenced the key, so the next read goes to the primary.
+	assert.Equal(t, BulkString("v"), server.processCommand(sess, &Command{Name: "HGET", Args: []string{"h", "f"}}))
+	assert.Equal(t, []string{"HSET h f v", "HGET h f"}, backend.received())
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Reply is a value that handlers return and an Encoder writes out in RESP.
+// The concrete types below are the only implementations. The RESP3 only types
+// are downgraded to their nearest RESP2 equivalent for clients that haven't
+// negotiated RESP3 with HELLO.
+type Reply interface {
+	reply()
+}
+
+// SimpleString is a non binary safe status reply, e.g. +OK.
+type SimpleString string
+
+// Error is an error reply, e.g. -ERR unknown command. By convention the first
+// word is an upper case error code.
+type Error string
+
+// Integer is a signed 64 bit integer reply, e.g. :1.
+type Integer int64
+
+// BulkString is a binary safe string reply, e.g. $3\r\nfoo.
+type BulkString string
+
+// Array is an ordered list of replies, which may themselves be arrays.
+type Array []Reply
+
+type nullReply byte
+
+// NullBulk is the null bulk string, $-1, returned for missing values. It is
+// written as the RESP3 null, _, to RESP3 clients.
+var NullBulk Reply = nullReply('$')
+
+// NullArray is the null array, *-1, returned when there is no list at all,
+// e.g. a timed out BLPOP. It is written as the RESP3 null, _, to RESP3
+// clients.
+var NullArray Reply = nullReply('*')
+
+// Map is a RESP3 map of alternating keys and values. RESP2 clients receive
+// a flat array of the same elements.
+type Map []Reply
+
+// Set is an unordered RESP3 collection. RESP2 clients receive an array.
+type Set []Reply
+
+// Double is a RESP3 floating point number. RESP2 clients receive it
+// formatted as a bulk string.
+type Double float64
+
+// Boolean is a RESP3 boolean. RESP2 clients receive the integer 1 or 0.
+type Boolean bool
+
+// BigNumber is a RESP3 arbitrary precision integer, in decimal. RESP2 clients
+// receive it as a bulk string.
+type BigNumber string
+
+// Verbatim is a RESP3 string with a three letter format hint, e.g. "txt" or
+// "mkd". RESP2 clients receive the text as a bulk string.
+type Verbatim struct {
+	Format string
+	Text   string
+}
+
+// Push is a RESP3 out of band message such as a pub/sub notification. RESP2
+// clients receive an array.
+type Push []Reply
+
+func (SimpleString) reply() {}
+func (Error) reply()        {}
+func (Integer) reply()      {}
+func (BulkString) reply()   {}
+func (Array) reply()        {}
+func (nullReply) reply()    {}
+func (Map) reply()          {}
+func (Set) reply()          {}
+func (Double) reply()       {}
+func (Boolean) reply()      {}
+func (BigNumber) reply()    {}
+func (Verbatim) reply()     {}
+func (Push) reply()         {}
+
+// Error allows an Error reply to be returned as a Go error.
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Encoder writes replies in RESP to a buffered writer. Nothing is sent until
+// the writer is flushed, so several replies can share one write.
+type Encoder struct {
+	w        *bufio.Writer
+	buf      []byte
+	protocol int
+}
+
+// NewEncoder returns an Encoder writing RESP2 to w.
+func NewEncoder(w *bufio.Writer) *Encoder {
+	return &Encoder{w: w, buf: make([]byte, 0, 32), protocol: 2}
+}
+
+// SetProtocol selects the RESP version, 2 or 3, used by later calls to Encode.
+func (e *Encoder) SetProtocol(version int) {
+	e.protocol = version
+}
+
+// Encode writes a single reply, recursing into aggregates.
+func (e *Encoder) Encode(r Reply) error {
+	resp3 := e.protocol >= 3
+	switch r := r.(type) {
+	case SimpleString:
+		return e.writeLine('+', sanitizeLine(string(r)))
+	case Error:
+		return e.writeLine('-', sanitizeLine(string(r)))
+	case Integer:
+		return e.writeNumber(':', int64(r))
+	case BulkString:
+		if err := e.writeNumber('$', int64(len(r))); err != nil {
+			return err
+		}
+		return e.writeLine(0, string(r))
+	case Array:
+		return e.writeAggregate('*', len(r), r)
+	case nullReply:
+		if resp3 {
+			return e.writeLine('_', "")
+		}
+		return e.writeNumber(byte(r), -1)
+	case Map:
+		if resp3 {
+			return e.writeAggregate('%', len(r)/2, r)
+		}
+		return e.writeAggregate('*', len(r), r)
+	case Set:
+		if resp3 {
+			return e.writeAggregate('~', len(r), r)
+		}
+		return e.writeAggregate('*', len(r), r)
+	case Push:
+		if resp3 {
+			return e.writeAggregate('>', len(r), r)
+		}
+		return e.writeAggregate('*', len(r), r)
+	case Double:
+		if resp3 {
+			return e.writeLine(',', formatDouble(float64(r)))
+		}
+		return e.Encode(BulkString(formatDouble(float64(r))))
+	case Boolean:
+		if resp3 {
+			if r {
+				return e.writeLine('#', "t")
+			}
+			return e.writeLine('#', "f")
+		}
+		if r {
+			return e.Encode(Integer(1))
+		}
+		return e.Encode(Integer(0))
+	case BigNumber:
+		if resp3 {
+			return e.writeLine('(', string(r))
+		}
+		return e.Encode(BulkString(r))
+	case Verbatim:
+		if resp3 {
+			if err := e.writeNumber('=', int64(len(r.Format)+1+len(r.Text))); err != nil {
+				return err
+			}
+			return e.writeLine(0, r.Format+":"+r.Text)
+		}
+		return e.Encode(BulkString(r.Text))
+	}
+	return fmt.Errorf("Can't encode reply of type %T", r)
+}
+
+// writeAggregate writes the header of an aggregate with the given number of
+// entries followed by each of the elements.
+func (e *Encoder) writeAggregate(prefix byte, n int, elements []Reply) error {
+	if err := e.writeNumber(prefix, int64(n)); err != nil {
+		return err
+	}
+	for _, element := range elements {
+		if err := e.Encode(element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatDouble formats f the way Redis does, with the infinities and NaN
+// spelled out.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeLine writes the prefix, if any, followed by s and a CRLF.
+func (e *Encoder) writeLine(prefix byte, s string) error {
+	if prefix != 0 {
+		e.w.WriteByte(prefix)
+	}
+	e.w.WriteString(s)
+	_, err := e.w.WriteString("\r\n")
+	return err
+}
+
+func (e *Encoder) writeNumber(prefix byte, n int64) error {
+	e.buf = append(e.buf[:0], prefix)
+	e.buf = strconv.AppendInt(e.buf, n, 10)
+	e.buf = append(e.buf, '\r', '\n')
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// sanitizeLine replaces newlines, which would otherwise end a simple string
+// or error early and corrupt the stream. Redis does the same.
+func sanitizeLine(s string) string {
+	if strings.IndexAny(s, "\r\n") < 0 {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(r Reply) string {
+	return encodeProtocol(r, 2)
+}
+
+func encodeProtocol(r Reply, version int) string {
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	encoder := NewEncoder(writer)
+	encoder.SetProtocol(version)
+	encoder.Encode(r)
+	writer.Flush()
+	return buf.String()
+}
+
+func TestEncodeScalars(t *testing.T) {
+	assert.Equal(t, "+PONG\r\n", encode(SimpleString("PONG")))
+	assert.Equal(t, "-ERR oops\r\n", encode(Error("ERR oops")))
+	assert.Equal(t, ":-42\r\n", encode(Integer(-42)))
+	assert.Equal(t, "$9\r\nmy\r\nvalue\r\n", encode(BulkString("my\r\nvalue")))
+	assert.Equal(t, "$0\r\n\r\n", encode(BulkString("")))
+	assert.Equal(t, "$-1\r\n", encode(NullBulk))
+	assert.Equal(t, "*-1\r\n", encode(NullArray))
+}
+
+func TestEncodeSanitizesLines(t *testing.T) {
+	assert.Equal(t, "-ERR bad  input\r\n", encode(Error("ERR bad\r\ninput")))
+	assert.Equal(t, "+a b\r\n", encode(SimpleString("a\nb")))
+}
+
+func TestEncodeArrays(t *testing.T) {
+	assert.Equal(t, "*0\r\n", encode(Array{}))
+	assert.Equal(t, "*3\r\n$1\r\na\r\n$-1\r\n:1\r\n",
+		encode(Array{BulkString("a"), NullBulk, Integer(1)}))
+	assert.Equal(t, "*2\r\n*1\r\n+OK\r\n*-1\r\n",
+		encode(Array{Array{SimpleString("OK")}, NullArray}))
+}
+
+func TestErrorReplyIsError(t *testing.T) {
+	var err error = Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	assert.Equal(t, "WRONGTYPE Operation against a key holding the wrong kind of value", err.Error())
+}
+
+func TestEncodeRESP3(t *testing.T) {
+	assert.Equal(t, "_\r\n", encodeProtocol(NullBulk, 3))
+	assert.Equal(t, "_\r\n", encodeProtocol(NullArray, 3))
+	assert.Equal(t, "%1\r\n$1\r\na\r\n:1\r\n", encodeProtocol(Map{BulkString("a"), Integer(1)}, 3))
+	assert.Equal(t, "~2\r\n+a\r\n+b\r\n", encodeProtocol(Set{SimpleString("a"), SimpleString("b")}, 3))
+	assert.Equal(t, ">1\r\n$7\r\nmessage\r\n", encodeProtocol(Push{BulkString("message")}, 3))
+	assert.Equal(t, ",1.5\r\n", encodeProtocol(Double(1.5), 3))
+	assert.Equal(t, ",-inf\r\n", encodeProtocol(Double(math.Inf(-1)), 3))
+	assert.Equal(t, "#t\r\n", encodeProtocol(Boolean(true), 3))
+	assert.Equal(t, "(3492890328409238509324850943850943825024385\r\n",
+		encodeProtocol(BigNumber("3492890328409238509324850943850943825024385"), 3))
+	assert.Equal(t, "=15\r\ntxt:Some string\r\n", encodeProtocol(Verbatim{"txt", "Some string"}, 3))
+}
+
+func TestEncodeRESP3DowngradedToRESP2(t *testing.T) {
+	assert.Equal(t, "*2\r\n$1\r\na\r\n:1\r\n", encode(Map{BulkString("a"), Integer(1)}))
+	assert.Equal(t, "*1\r\n+a\r\n", encode(Set{SimpleString("a")}))
+	assert.Equal(t, "*1\r\n$7\r\nmessage\r\n", encode(Push{BulkString("message")}))
+	assert.Equal(t, "$3\r\n1.5\r\n", encode(Double(1.5)))
+	assert.Equal(t, ":0\r\n", encode(Boolean(false)))
+	assert.Equal(t, "$2\r\n12\r\n", encode(BigNumber("12")))
+	assert.Equal(t, "$11\r\nSome string\r\n", encode(Verbatim{"txt", "Some string"}))
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RingAddrs returns the shards of a redis.Ring given by specs of the form
+// name=host:port, or name=host:port*weight. The ring hashes shard names, not
+// addresses, so a shard can move without its keys moving with it.
+//
+// The ring has no weights of its own. A shard of weight n is added to it n
+// times, under its name and then name#1 to name#n-1, each with its own
+// connections to the server. A shard of weight 1 is only added under its
+// name, so it has the same keys as in any other go-redis ring.
+func RingAddrs(specs []string) (map[string]string, error) {
+	addrs := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid ring shard '%s', expected name=host:port", spec)
+		}
+		name, addr := parts[0], parts[1]
+		weight := 1
+		if at := strings.LastIndexByte(addr, '*'); at >= 0 {
+			var err error
+			weight, err = strconv.Atoi(addr[at+1:])
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("Invalid ring shard '%s', the weight must be a positive integer", spec)
+			}
+			addr = addr[:at]
+		}
+
+		for i := 0; i < weight; i++ {
+			replica := name
+			if i > 0 {
+				replica = fmt.Sprintf("%s#%d", name, i)
+			}
+			if _, exists := addrs[replica]; exists {
+				return nil, fmt.Errorf("Ring shard '%s' is given twice", replica)
+			}
+			addrs[replica] = addr
+		}
+	}
+	return addrs, nil
+}
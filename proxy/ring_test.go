@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingAddrs(t *testing.T) {
+	addrs, err := RingAddrs([]string{"a=10.0.0.1:6379", "b=10.0.0.2:6379*3"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"a":   "10.0.0.1:6379",
+		"b":   "10.0.0.2:6379",
+		"b#1": "10.0.0.2:6379",
+		"b#2": "10.0.0.2:6379",
+	}, addrs)
+
+	_, err = RingAddrs([]string{"10.0.0.1:6379"})
+	assert.NotNil(t, err)
+	_, err = RingAddrs([]string{"a=10.0.0.1:6379*0"})
+	assert.NotNil(t, err)
+	_, err = RingAddrs([]string{"a=10.0.0.1:6379*x"})
+	assert.NotNil(t, err)
+	_, err = RingAddrs([]string{"a=10.0.0.1:6379", "a=10.0.0.2:6379"})
+	assert.NotNil(t, err)
+}
+
+func TestRingRefusesKeyspaceCommands(t *testing.T) {
+	ring := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"a": "localhost:1", "b": "localhost:2"}})
+	defer ring.Close()
+	server := NewServer(nil, ring, &Options{Passthrough: true})
+
+	for _, name := range []string{"SCAN", "DBSIZE", "RANDOMKEY"} {
+		resp := server.processCommand(newTestSession(), &Command{Name: name})
+		assert.Equal(t, Error("ERR command '"+strings.ToLower(name)+"' is not allowed through the proxy"), resp)
+	}
+}
+
+func TestRingForward(t *testing.T) {
+	// The ring asks the backend for its COMMAND table first.
+	backend := newFakeRedis(t, map[string]string{"COMMAND": "*0\r\n", "HSET": ":1\r\n"})
+	defer backend.close()
+	ring := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"a": backend.addr()}})
+	defer ring.Close()
+
+	for i := 0; i < 100; i++ {
+		resp, err := forward(ring, &Command{Name: "HSET", Args: []string{"h", "f", "v"}})
+		assert.Nil(t, err)
+		assert.Equal(t, Integer(1), resp)
+	}
+	for _, command := range backend.received()[1:] {
+		assert.Equal(t, "HSET h f v", command)
+	}
+}
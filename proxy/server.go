@@ -2,10 +2,12 @@ package proxy
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/eastside-eng/redis-proxy/cache"
 	. "github.com/eastside-eng/redis-proxy/log"
@@ -16,50 +18,266 @@ import (
 // responds to RESP (Redis Serialization Protocol) commands. The server keeps
 // a stateful cache and delegates calls to the redis-go library.
 type Server struct {
-	cache       *cache.DecayingLRUCache
-	redisClient *redis.Client
+	// The id given to the most recent connection. Kept first for 64 bit
+	// alignment of atomic operations.
+	lastSessionID int64
+	// writeEpoch counts the writes made through the proxy. It is only
+	// incremented while holding writeLock, see applyWrite.
+	writeEpoch uint64
+	// The number of background refreshes of stale entries, see refresh.
+	refreshes uint64
+	// The number of expired values served because the backend failed, see
+	// serveStale.
+	staleServed uint64
+	// The number of times the backend was replaced, see FailoverDetector.
+	failovers uint64
+
+	cache       cache.Cache
+	negative    cache.Cache
+	redisClient redis.UniversalClient
+	opt         *Options
+	// The backend database, which together with the key identifies a value.
+	db int
+	// For a backend sharded across several servers, shardKey returns what
+	// decides which server a key is on. Keys with the same shardKey are on the
+	// same server. It's nil for a single server. See keyGroups.
+	shardKey func(key string) interface{}
+
+	// Fetches from the backend in progress, see fetchKeys.
+	flights *flightGroup
+
+	// The commands refused in pass-through mode.
+	denied map[string]bool
+
+	writeLock sync.RWMutex
+	// Serialise writes to the same key, see writeHandler.
+	keyLocks keyLocks
 }
 
-// NewServer returns a new Server instance.
-func NewServer(cache *cache.DecayingLRUCache, redisClient *redis.Client) *Server {
-	server := &Server{cache, redisClient}
+// Options configures the behaviour of a Server.
+type Options struct {
+	// The largest bulk string accepted from a client, in bytes. Commands with
+	// larger arguments are rejected as protocol errors.
+	// Default is DefaultMaxBulkLength.
+	MaxBulkLength int
+
+	// Passthrough forwards commands without a handler to the backend verbatim
+	// instead of rejecting them as unknown. Writes among them still update
+	// the cache if the command table knows which keys they write.
+	Passthrough bool
+	// The commands that are never forwarded in pass-through mode.
+	// Default is DefaultDeniedCommands.
+	DeniedCommands []string
+
+	// NegativeCache holds the keys known to be missing from the backend, so
+	// that reads of them don't reach it. It is kept apart from the cache of
+	// values so that each has its own TTL and limits.
+	// Default is to cache nothing.
+	NegativeCache cache.Cache
+
+	// FailoverDetector, if set, is given the backend client's new connections
+	// and has the server flush its caches when they reach a new primary.
+	FailoverDetector *FailoverDetector
+
+	// SlotMap, if set, has the server present itself to clients as a node of
+	// a Redis Cluster made up of the proxies in the map. Commands for keys in
+	// slots served by another proxy are redirected to it with MOVED.
+	// Default is to present a single, non-cluster Redis.
+	SlotMap *SlotMap
+
+	// Replicas, if set, are replicas of the backend that reads are sent to.
+	// Default is to send everything to the backend.
+	Replicas *ReplicaSet
+}
+
+func (opt *Options) init() {
+	if opt.MaxBulkLength <= 0 {
+		opt.MaxBulkLength = DefaultMaxBulkLength
+	}
+	if opt.DeniedCommands == nil {
+		opt.DeniedCommands = DefaultDeniedCommands
+	}
+	if opt.NegativeCache == nil {
+		opt.NegativeCache = &cache.NoopCache{}
+	}
+}
+
+// NewServer returns a new Server instance. The backend is either a single
+// Redis, possibly found through Sentinel, a Redis Cluster, or a Ring of
+// Redis servers sharded by consistent hashing.
+func NewServer(cache cache.Cache, redisClient redis.UniversalClient, opt *Options) *Server {
+	opt.init()
+	server := &Server{
+		cache:       cache,
+		negative:    opt.NegativeCache,
+		redisClient: redisClient,
+		opt:         opt,
+		flights:     newFlightGroup(),
+		denied:      make(map[string]bool),
+	}
+	switch client := redisClient.(type) {
+	case *redis.Client:
+		server.db = client.Options().DB
+	case *redis.ClusterClient:
+		server.shardKey = func(key string) interface{} { return keySlot(key) }
+	case *redis.Ring:
+		// We can't see which shard the ring will pick, but it only hashes
+		// the hashtag.
+		server.db = client.Options().DB
+		server.shardKey = func(key string) interface{} { return hashTag(key) }
+	}
+	if cache != nil {
+		cache.SetRefresher(server.refresh)
+	}
+	if opt.FailoverDetector != nil {
+		opt.FailoverDetector.setOnFailover(server.failover)
+	}
+	for _, name := range opt.DeniedCommands {
+		server.denied[strings.ToUpper(name)] = true
+	}
 	return server
 }
 
+// session is the per-connection state shared by the handlers of a client's
+// commands.
+type session struct {
+	server *Server
+	id     int64
+
+	// The RESP version negotiated with HELLO, 2 or 3.
+	protocol int
+	// The name given with HELLO SETNAME.
+	name string
+
+	encoder *Encoder
+}
+
+func (s *Server) newSession(writer *bufio.Writer) *session {
+	return &session{
+		server:   s,
+		id:       atomic.AddInt64(&s.lastSessionID, 1),
+		protocol: 2,
+		encoder:  NewEncoder(writer),
+	}
+}
+
+// setProtocol switches the RESP version used for this and later replies.
+func (sess *session) setProtocol(version int) {
+	sess.protocol = version
+	sess.encoder.SetProtocol(version)
+}
+
 // Process accepts a new tcpConn and will listen for incoming bytes, parse them into
 // commands and then execute them.
 func (s *Server) process(tcpConn net.Conn) {
 	defer tcpConn.Close()
 
+	reader := NewReader(tcpConn, s.opt.MaxBulkLength)
+	writer := bufio.NewWriter(tcpConn)
+	sess := s.newSession(writer)
 	for {
-		// This is fixed to 1024, but we could make this bigger. RESP supposedly
-		// supports up to 512 MB BulkStrings.
-		bytes := make([]byte, 1024)
-		_, err := tcpConn.Read(bytes)
-
-		Logger.Infow("Processing connection", "bytes", len(bytes), "err", err)
-		if err != nil {
-			Logger.Warnw("Received an error from connection", "err", err)
-			if err == io.EOF {
+		commands, err := readPipeline(reader)
+		if len(commands) > 0 {
+			Logger.Infow("Processing commands", "count", len(commands))
+			quit := s.processPipeline(sess, commands)
+			if err := writer.Flush(); err != nil {
+				Logger.Warnw("Failed to write reply", "err", err)
+				return
+			}
+			if quit {
 				return
 			}
 		}
-		command, err := parseCommand(bytes)
 		if err != nil {
-			Logger.Warnw("Failed to parse command", "command", command)
-			continue
+			if err, ok := err.(*ProtocolError); ok {
+				// We can't find the start of the next command after a bad one, so
+				// like Redis we report the error and drop the connection.
+				sess.encoder.Encode(Error("ERR " + err.Error()))
+				writer.Flush()
+			}
+			if err != io.EOF {
+				Logger.Warnw("Failed to read command", "err", err)
+			}
+			return
 		}
+	}
+}
+
+// maxPipelineLength bounds the number of queued commands executed as one batch.
+const maxPipelineLength = 1024
 
-		resp, err := s.processCommand(command)
+// readPipeline blocks for one command and then drains any further commands
+// the client has already sent, so pipelined requests are executed together.
+// Commands read before an error are returned alongside it.
+func readPipeline(reader *Reader) ([]*Command, error) {
+	var commands []*Command
+	for len(commands) == 0 || (reader.Buffered() > 0 && len(commands) < maxPipelineLength) {
+		command, err := reader.ReadCommand()
 		if err != nil {
-			Logger.Errorw("Failed to process command", "command", command, "err", err)
+			return commands, err
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+// processPipeline executes commands in order and encodes their replies in the
+// same order. GETs that miss the cache are deferred and fetched from the
+// backend in a single round-trip, which is flushed before any other command
+// runs so that replies never observe a reordered backend.
+//
+// QUIT is answered here, as it closes the client's connection rather than
+// the backend's. Like Redis, commands after it are dropped, and quit is
+// returned true.
+func (s *Server) processPipeline(sess *session, commands []*Command) (quit bool) {
+	replies := make([]Reply, len(commands))
+	var misses []int
+	// Replies before this index have been encoded.
+	encoded := 0
+
+	encodeUpTo := func(end int) {
+		for ; encoded < end; encoded++ {
+			sess.encoder.Encode(replies[encoded])
+		}
+	}
+
+	fetchMisses := func() {
+		if len(misses) == 0 {
+			return
+		}
+		keys := make([]string, len(misses))
+		for i, index := range misses {
+			keys[i] = commands[index].Args[0]
+		}
+		for i, resp := range s.fetchKeys(keys) {
+			replies[misses[i]] = resp
+		}
+		misses = misses[:0]
+	}
+
+	for i, command := range commands {
+		if command.Name == "GET" && len(command.Args) == 1 && s.serves(command.Args[0]) {
+			if resp, exists := s.cached(command.Args[0]); exists {
+				replies[i] = resp
+			} else {
+				misses = append(misses, i)
+			}
 			continue
 		}
 
-		writer := bufio.NewWriter(tcpConn)
-		writer.Write(resp)
-		writer.Flush()
+		fetchMisses()
+		// Earlier replies are encoded before the command runs, as it may change
+		// the protocol they should be written in.
+		encodeUpTo(i)
+		if command.Name == "QUIT" {
+			sess.encoder.Encode(SimpleString("OK"))
+			return true
+		}
+		replies[i] = s.processCommand(sess, command)
 	}
+	fetchMisses()
+	encodeUpTo(len(commands))
+	return false
 }
 
 // Run spawns a TCP server on the port given and begins accepting incoming
@@ -73,6 +291,12 @@ func (s *Server) Run(port int) {
 
 	defer s.cache.Stop()
 	s.cache.Start()
+	defer s.negative.Stop()
+	s.negative.Start()
+	if s.opt.Replicas != nil {
+		defer s.opt.Replicas.Stop()
+		s.opt.Replicas.Start()
+	}
 
 	for {
 		tcpConn, err := listener.Accept()
@@ -85,66 +309,78 @@ func (s *Server) Run(port int) {
 	}
 }
 
-// RespNIL is a constant representing the RESP Nil value
-var RespNIL = []byte("$-1\r\n")
-
-// RespEncodeString encodes a given string into RESP
-func RespEncodeString(str string) []byte {
-	res := fmt.Sprintf("$%d\r\n%s\r\n", len(str), str)
-	return []byte(res)
-}
-
-// RespEncodeInteger encodes a given integer into RESP
-func RespEncodeInteger(i int) []byte {
-	res := fmt.Sprintf(":%d\r\n", i)
-	return []byte(res)
-}
+// processCommand runs the handler for a command and returns its reply. Every
+// failure is turned into an error reply, so a client always gets an answer.
+func (s *Server) processCommand(sess *session, command *Command) Reply {
+	spec, name := lookupCommand(command)
+	if emulated, exists := clusterCommands[name]; exists && s.opt.SlotMap != nil {
+		spec = emulated
+	}
+	if spec != nil && spec.forward && spec.flags&flagWrite != 0 && !s.opt.Passthrough {
+		// Writes the proxy has no handler for, scripts among them, are only
+		// run in pass-through mode. The table just says how to keep the cache
+		// in line with them.
+		spec = nil
+	}
+	if spec == nil {
+		if !s.opt.Passthrough {
+			return unknownError(command, name)
+		}
+		spec = passthroughSpec
+	}
+	if !spec.checkArity(command) {
+		return wrongArityError(name)
+	}
+	if s.opt.SlotMap != nil {
+		if resp := s.opt.SlotMap.route(spec.keys.keysOf(command)); resp != nil {
+			return resp
+		}
+	}
 
-// Handlers are executed per-command and should execute any side effects.
-type handler func(cache *cache.DecayingLRUCache, redisClient *redis.Client, command *Command) ([]byte, error)
-
-var getHandler handler = func(cache *cache.DecayingLRUCache, redisClient *redis.Client, command *Command) ([]byte, error) {
-	key := command.Args[0]
-	resp, exists := cache.Get(key)
-	Logger.Infow("Invoking GET on cache",
-		"key", key,
-		"cache-entry", resp)
-	if !exists {
-		resp := redisClient.Get(key)
-		val, err := resp.Result()
-		Logger.Infow("Invoking GET on backing Redis",
-			"key", key,
-			"redis-entry", val)
-		if err != nil {
-			return RespNIL, nil
+	handler := spec.handler
+	if spec.forward {
+		if !s.forwardable(name) {
+			return Error("ERR command '" + strings.ToLower(name) + "' is not allowed through the proxy")
+		}
+		handler = forwardHandler
+		if spec.flags&flagWrite != 0 {
+			// Forwarded writes update the cache like any other.
+			handler = writeHandler
 		}
-		bytes := RespEncodeString(val)
-		cache.Add(key, bytes)
-		return bytes, nil
 	}
-	return resp.([]byte), nil
+
+	resp, err := handler(sess, command)
+	if err != nil {
+		Logger.Infow("Error handling command", "command", command, "err", err)
+		return errorReply(err)
+	}
+	if spec.forward && sess.protocol >= 3 {
+		resp = resp3Reply(name, command, resp)
+	}
+	return resp
 }
 
-var pingHandler handler = func(cache *cache.DecayingLRUCache, redisClient *redis.Client, command *Command) ([]byte, error) {
-	return RespEncodeString("PONG"), nil
+// serves reports whether the server serves the key itself, rather than
+// redirecting clients to another proxy of its cluster.
+func (s *Server) serves(key string) bool {
+	return s.opt.SlotMap == nil || s.opt.SlotMap.route([]string{key}) == nil
 }
 
-// A map of supported handlers for Redis commands.
-var handlers = map[string]handler{
-	"GET":  getHandler,
-	"PING": pingHandler,
+// reader returns the backend client reads of the keys should be sent to.
+func (s *Server) reader(keys []string) redis.UniversalClient {
+	if s.opt.Replicas == nil {
+		return s.redisClient
+	}
+	return s.opt.Replicas.reader(keys)
 }
 
-// ProcessCommand ..
-func (s *Server) processCommand(command *Command) ([]byte, error) {
-	handler, exists := handlers[command.Name]
-	if exists {
-		resp, err := handler(s.cache, s.redisClient, command)
-		if err != nil {
-			Logger.Infow("Error handling command", "command", command, "err", err)
-			return nil, err
-		}
-		return resp, nil
+// clientFor returns the backend client a command should be sent to. Commands
+// that only read keys may go to a replica, everything else, including
+// commands the proxy doesn't know, goes to the primary.
+func (s *Server) clientFor(command *Command) redis.UniversalClient {
+	spec, _ := lookupCommand(command)
+	if spec == nil || spec.flags&flagRead == 0 || spec.flags&flagWrite != 0 {
+		return s.redisClient
 	}
-	return nil, errors.New("No handler for command")
+	return s.reader(spec.keys.keysOf(command))
 }
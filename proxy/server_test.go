@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/eastside-eng/redis-proxy/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logger := log.NewLogger()
+	log.SetLogger(logger)
+}
+
+func TestReadPipeline(t *testing.T) {
+	raw := "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"
+	reader := NewReader(strings.NewReader(raw), DefaultMaxBulkLength)
+
+	commands, err := readPipeline(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(commands))
+	assert.Equal(t, "PING", commands[0].Name)
+	assert.Equal(t, "b", commands[2].Args[0])
+
+	commands, err = readPipeline(reader)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, len(commands))
+}
+
+func TestReadPipelineError(t *testing.T) {
+	raw := "*1\r\n$4\r\nPING\r\n*1\r\n$x\r\n"
+	reader := NewReader(strings.NewReader(raw), DefaultMaxBulkLength)
+
+	commands, err := readPipeline(reader)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(commands))
+}
+
+func TestProcessReportsErrors(t *testing.T) {
+	server := &Server{opt: &Options{MaxBulkLength: DefaultMaxBulkLength}}
+	client, conn := net.Pipe()
+	go server.process(conn)
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	client.Write([]byte("FOO bar\r\n"))
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "-ERR unknown command 'FOO', with args beginning with: 'bar' \r\n", line)
+
+	client.Write([]byte("*x\r\n"))
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "-ERR Protocol error: invalid multibulk length\r\n", line)
+
+	_, err := reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestProcessQuit(t *testing.T) {
+	server := &Server{opt: &Options{MaxBulkLength: DefaultMaxBulkLength}}
+	client, conn := net.Pipe()
+	go server.process(conn)
+	defer client.Close()
+
+	// Commands pipelined after QUIT are dropped.
+	reader := bufio.NewReader(client)
+	client.Write([]byte("PING\r\nQUIT\r\nPING\r\n"))
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "+PONG\r\n", line)
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "+OK\r\n", line)
+
+	_, err := reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+// fakeRedis is a backend for tests. It answers each command with a canned
+// RESP reply chosen by the command's name, +OK if there's none, and records
+// the commands it's sent.
+type fakeRedis struct {
+	listener net.Listener
+	replies  map[string]string
+
+	lock     sync.Mutex
+	commands []string
+	// If set, replies wait until it's closed.
+	hold chan struct{}
+}
+
+func newFakeRedis(t *testing.T, replies map[string]string) *fakeRedis {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRedis{listener: listener, replies: replies}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+func (fake *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := NewReader(conn, DefaultMaxBulkLength)
+	for {
+		command, err := reader.ReadCommand()
+		if err != nil {
+			return
+		}
+		fake.lock.Lock()
+		fake.commands = append(fake.commands, strings.Join(append([]string{command.Name}, command.Args...), " "))
+		hold := fake.hold
+		fake.lock.Unlock()
+
+		if hold != nil {
+			<-hold
+		}
+		reply, exists := fake.replies[command.Name]
+		if !exists {
+			reply = "+OK\r\n"
+		}
+		conn.Write([]byte(reply))
+	}
+}
+
+func (fake *fakeRedis) addr() string {
+	return fake.listener.Addr().String()
+}
+
+// received returns the commands sent so far, as space separated words.
+func (fake *fakeRedis) received() []string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return append([]string(nil), fake.commands...)
+}
+
+func (fake *fakeRedis) close() {
+	fake.listener.Close()
+}
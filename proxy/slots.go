@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// slotCount is the number of hash slots a Redis Cluster divides keys between.
+const slotCount = 16384
+
+// keySlot returns the cluster hash slot of a key.
+func keySlot(key string) int {
+	return int(crc16(hashTag(key)) % slotCount)
+}
+
+// hashTag returns the part of a key that is hashed to find its slot, or its
+// shard of a ring. If the key contains a non-empty {hashtag}, only the
+// hashtag is hashed, so that related keys can be kept together.
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster hashes keys with.
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^key[i]]
+	}
+	return crc
+}
+
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// keyGroups splits the keys of a multi-key command into groups that can each
+// be sent to the backend as one command, returning the indexes of the keys in
+// each group, in the order the groups first appear. A backend sharded across
+// several servers can't run a command whose keys are on different servers, so
+// keys are grouped by shardKey. A single server takes all the keys at once.
+func (s *Server) keyGroups(keys []string) [][]int {
+	if s.shardKey == nil {
+		group := make([]int, len(keys))
+		for i := range keys {
+			group[i] = i
+		}
+		return [][]int{group}
+	}
+
+	var groups [][]int
+	shards := make(map[interface{}]int)
+	for i, key := range keys {
+		shard := s.shardKey(key)
+		at, exists := shards[shard]
+		if !exists {
+			at = len(groups)
+			shards[shard] = at
+			groups = append(groups, nil)
+		}
+		groups[at] = append(groups[at], i)
+	}
+	return groups
+}
+
+// splitCommands are the multi-key commands that forwardSplit splits up,
+// with the number of arguments given per key.
+var splitCommands = map[string]int{
+	"DEL":    1,
+	"EXISTS": 1,
+	"MSET":   2,
+	"UNLINK": 1,
+}
+
+// forwardSplit forwards a command to the client like forward, except that a
+// splitCommands command whose keys may be on different servers of a sharded
+// backend is sent as one command per group of keys, see keyGroups, pipelined,
+// and their replies merged. Integer replies are summed, others must all be
+// the same. A split MSET doesn't set the keys of different groups atomically.
+func forwardSplit(s *Server, client redis.UniversalClient, command *Command) (Reply, error) {
+	stride, split := splitCommands[command.Name]
+	if s.shardKey == nil || !split {
+		return forward(client, command)
+	}
+
+	keys := make([]string, 0, len(command.Args)/stride)
+	for i := 0; i < len(command.Args); i += stride {
+		keys = append(keys, command.Args[i])
+	}
+	groups := s.keyGroups(keys)
+	if len(groups) == 1 {
+		return forward(client, command)
+	}
+
+	pipe := client.Pipeline()
+	defer pipe.Close()
+
+	commands := make([]*Command, len(groups))
+	cmds := make([]*redis.Cmd, len(groups))
+	for i, group := range groups {
+		args := make([]string, 0, len(group)*stride)
+		for _, at := range group {
+			args = append(args, command.Args[at*stride:(at+1)*stride]...)
+		}
+		commands[i] = &Command{Name: command.Name, Args: args}
+		cmds[i] = newCmd(commands[i])
+		pipe.Process(cmds[i])
+	}
+	// Errors are reported per command below.
+	pipe.Exec()
+
+	var merged Reply
+	for i, cmd := range cmds {
+		resp, err := forwardedReply(commands[i], cmd)
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = resp
+			continue
+		}
+		sum, sumOK := merged.(Integer)
+		n, nOK := resp.(Integer)
+		switch {
+		case sumOK && nOK:
+			merged = sum + n
+		case sumOK || nOK || !sameReply(merged, resp):
+			return nil, unexpectedReplyError
+		}
+	}
+	return merged, nil
+}
+
+// sameReply reports whether two replies that aren't integers are equal. Only
+// replies of comparable types, e.g. +OK, can be.
+func sameReply(a, b Reply) bool {
+	switch a.(type) {
+	case SimpleString, BulkString, Error, nullReply:
+		return a == b
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/eastside-eng/redis-proxy/cache"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+	assert.Equal(t, 12182, keySlot("foo"))
+	assert.Equal(t, 5061, keySlot("bar"))
+
+	// Only the first hashtag counts, and only if it's non-empty.
+	assert.Equal(t, keySlot("user1000"), keySlot("{user1000}.following"))
+	assert.Equal(t, keySlot("{user1000}.followers"), keySlot("{user1000}.following"))
+	assert.Equal(t, keySlot("bar"), keySlot("foo{bar}{zap}"))
+	assert.Equal(t, keySlot("{bar"), keySlot("foo{{bar}}zap"))
+	assert.NotEqual(t, keySlot("bar"), keySlot("foo{}{bar}"))
+}
+
+func TestKeyGroups(t *testing.T) {
+	server := NewServer(nil, nil, &Options{})
+	keys := []string{"foo", "bar", "{foo}.a", "{bar}.b", "baz"}
+	assert.Equal(t, [][]int{{0, 1, 2, 3, 4}}, server.keyGroups(keys))
+
+	server = NewServer(nil, redis.NewClusterClient(&redis.ClusterOptions{}), &Options{})
+	assert.Equal(t, [][]int{{0, 2}, {1, 3}, {4}}, server.keyGroups(keys))
+
+	// A ring's shards can't be told apart, only keys with the same hashtag.
+	keys = []string{"foo", "{foo}.a", "{x}.b", "x", "x"}
+	server = NewServer(nil, redis.NewRing(&redis.RingOptions{}), &Options{})
+	assert.Equal(t, [][]int{{0, 1}, {2, 3, 4}}, server.keyGroups(keys))
+}
+
+func TestForwardSplitUnexpectedReply(t *testing.T) {
+	// The ring asks the backend for its COMMAND table first.
+	backend := newFakeRedis(t, map[string]string{"COMMAND": "*0\r\n", "DEL": "*0\r\n", "EXISTS": "+OK\r\n"})
+	defer backend.close()
+	// Both shards are the same server, but the proxy can't tell.
+	ring := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"a": backend.addr(), "b": backend.addr()}})
+	defer ring.Close()
+	server := NewServer(&cache.NoopCache{}, ring, &Options{})
+	sess := server.newSession(nil)
+
+	_, err := forwardSplit(server, ring, &Command{Name: "DEL", Args: []string{"x", "y"}})
+	assert.Equal(t, unexpectedReplyError, err)
+
+	resp := server.processCommand(sess, &Command{Name: "EXISTS", Args: []string{"x"}})
+	assert.Equal(t, unexpectedReplyError, resp)
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// commandSpec describes a command the proxy implements.
+type commandSpec struct {
+	// arity follows the Redis convention: the number of words in the command
+	// including its name, and subcommand if any. A negative arity means at
+	// least -arity words.
+	arity   int
+	handler handler
+	// forward is set for commands the proxy passes through to the backend
+	// unchanged rather than handling itself.
+	forward bool
+	// keys says which arguments are keys, for routing by hash slot.
+	keys keySpec
+	// flags describe what the command does to the keyspace, see flagRead.
+	flags int
+}
+
+// Command flags, like those Redis gives in COMMAND.
+const (
+	// flagRead is set for commands that read keys. If they don't also write
+	// them, they may be sent to a replica, see Server.clientFor.
+	flagRead = 1 << iota
+	// flagWrite is set for commands that may modify keys.
+	flagWrite
+)
+
+// keySpec gives the positions of a command's keys the way Redis' COMMAND
+// does: the first and last key, counting the command name as 0 and negative
+// positions from the end, and the step between keys. The zero keySpec is a
+// command without keys.
+//
+// Commands such as EVAL and ZUNIONSTORE say how many keys they take in one of
+// their arguments. For them numkeys is that argument's position, and as many
+// keys as it gives follow it, after any keys from first to last.
+type keySpec struct {
+	first, last, step int
+	numkeys           int
+}
+
+var (
+	// oneKey is a command whose first argument is its only key.
+	oneKey = keySpec{1, 1, 1, 0}
+	// twoKeys is a command whose first two arguments are its keys.
+	twoKeys = keySpec{1, 2, 1, 0}
+	// allKeys is a command whose arguments are all keys.
+	allKeys = keySpec{1, -1, 1, 0}
+	// pairKeys is a command taking key value pairs.
+	pairKeys = keySpec{1, -1, 2, 0}
+	// subcommandKey is a subcommand whose argument is its only key.
+	subcommandKey = keySpec{2, 2, 1, 0}
+	// scriptKeys is a script call, whose keys follow their count.
+	scriptKeys = keySpec{numkeys: 2}
+	// storeKeys is a sorted set operation storing into its first argument
+	// what it computes from the keys after their count.
+	storeKeys = keySpec{1, 1, 1, 2}
+)
+
+// keysOf returns the keys of the command, which must have passed the spec's
+// arity check.
+func (spec keySpec) keysOf(command *Command) []string {
+	var keys []string
+	if spec.first > 0 {
+		last := spec.last
+		if last < 0 {
+			last += len(command.Args) + 1
+		}
+		for i := spec.first; i <= last && i <= len(command.Args); i += spec.step {
+			keys = append(keys, command.Args[i-1])
+		}
+	}
+	if spec.numkeys > 0 && spec.numkeys <= len(command.Args) {
+		// A bad count is left for the backend to refuse.
+		n, _ := strconv.Atoi(command.Args[spec.numkeys-1])
+		for i := spec.numkeys + 1; i <= spec.numkeys+n && i <= len(command.Args); i++ {
+			keys = append(keys, command.Args[i-1])
+		}
+	}
+	return keys
+}
+
+// passthroughSpec is used for commands without a spec in pass-through mode.
+// The backend is left to check their arity.
+var passthroughSpec = &commandSpec{arity: -1, forward: true}
+
+// commandTable maps command names to their specs. Subcommands of container
+// commands are registered as CONTAINER|SUBCOMMAND, e.g. CLIENT|SETNAME, and
+// the container itself is registered with neither a handler nor forward set.
+var commandTable = map[string]*commandSpec{
+	"EXISTS": {arity: -2, handler: existsHandler, keys: allKeys, flags: flagRead},
+	"GET":    {arity: 2, handler: getHandler, keys: oneKey, flags: flagRead},
+	"HELLO":  {arity: -1, handler: helloHandler},
+	"INFO":   {arity: -1, handler: infoHandler},
+	"MGET":   {arity: -2, handler: mgetHandler, keys: allKeys, flags: flagRead},
+	"PING":   {arity: -1, handler: pingHandler},
+
+	// Reads of other types, which the proxy doesn't cache.
+	"GETRANGE":  {arity: 4, forward: true, keys: oneKey, flags: flagRead},
+	"HEXISTS":   {arity: 3, forward: true, keys: oneKey, flags: flagRead},
+	"HGET":      {arity: 3, forward: true, keys: oneKey, flags: flagRead},
+	"HGETALL":   {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"HLEN":      {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"HMGET":     {arity: -3, forward: true, keys: oneKey, flags: flagRead},
+	"LINDEX":    {arity: 3, forward: true, keys: oneKey, flags: flagRead},
+	"LLEN":      {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"LRANGE":    {arity: 4, forward: true, keys: oneKey, flags: flagRead},
+	"PTTL":      {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"SCARD":     {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"SISMEMBER": {arity: 3, forward: true, keys: oneKey, flags: flagRead},
+	"SMEMBERS":  {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"STRLEN":    {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"TTL":       {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"TYPE":      {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"ZCARD":     {arity: 2, forward: true, keys: oneKey, flags: flagRead},
+	"ZRANGE":    {arity: -4, forward: true, keys: oneKey, flags: flagRead},
+	"ZRANK":     {arity: -3, forward: true, keys: oneKey, flags: flagRead},
+	"ZSCORE":    {arity: 3, forward: true, keys: oneKey, flags: flagRead},
+
+	"APPEND":      {arity: 3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"DECR":        {arity: 2, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"DECRBY":      {arity: 3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"DEL":         {arity: -2, handler: writeHandler, keys: allKeys, flags: flagWrite},
+	"EXPIRE":      {arity: -3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"EXPIREAT":    {arity: -3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"GETDEL":      {arity: 2, handler: writeHandler, keys: oneKey, flags: flagRead | flagWrite},
+	"GETEX":       {arity: -2, handler: writeHandler, keys: oneKey, flags: flagRead | flagWrite},
+	"GETSET":      {arity: 3, handler: writeHandler, keys: oneKey, flags: flagRead | flagWrite},
+	"INCR":        {arity: 2, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"INCRBY":      {arity: 3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"INCRBYFLOAT": {arity: 3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"MSET":        {arity: -3, handler: writeHandler, keys: pairKeys, flags: flagWrite},
+	"MSETNX":      {arity: -3, handler: writeHandler, keys: pairKeys, flags: flagWrite},
+	"PERSIST":     {arity: 2, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"PEXPIRE":     {arity: -3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"PEXPIREAT":   {arity: -3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"PSETEX":      {arity: 4, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"RENAME":      {arity: 3, handler: writeHandler, keys: twoKeys, flags: flagWrite},
+	"RENAMENX":    {arity: 3, handler: writeHandler, keys: twoKeys, flags: flagWrite},
+	"SET":         {arity: -3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"SETEX":       {arity: 4, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"SETNX":       {arity: 3, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"SETRANGE":    {arity: 4, handler: writeHandler, keys: oneKey, flags: flagWrite},
+	"UNLINK":      {arity: -2, handler: writeHandler, keys: allKeys, flags: flagWrite},
+
+	// Other writes that may change or replace a cached value. They are only
+	// forwarded in pass-through mode, and then invalidate it, see
+	// Server.processCommand.
+	"BITFIELD":    {arity: -2, forward: true, keys: oneKey, flags: flagRead | flagWrite},
+	"BITOP":       {arity: -4, forward: true, keys: keySpec{2, -1, 1, 0}, flags: flagWrite},
+	"COPY":        {arity: -3, forward: true, keys: twoKeys, flags: flagWrite},
+	"EVAL":        {arity: -3, forward: true, keys: scriptKeys, flags: flagWrite},
+	"EVALSHA":     {arity: -3, forward: true, keys: scriptKeys, flags: flagWrite},
+	"FCALL":       {arity: -3, forward: true, keys: scriptKeys, flags: flagWrite},
+	"FLUSHALL":    {arity: -1, forward: true, flags: flagWrite},
+	"FLUSHDB":     {arity: -1, forward: true, flags: flagWrite},
+	"MOVE":        {arity: 3, forward: true, keys: oneKey, flags: flagWrite},
+	"PFADD":       {arity: -2, forward: true, keys: oneKey, flags: flagWrite},
+	"PFMERGE":     {arity: -2, forward: true, keys: allKeys, flags: flagWrite},
+	"RESTORE":     {arity: -4, forward: true, keys: oneKey, flags: flagWrite},
+	"SDIFFSTORE":  {arity: -3, forward: true, keys: allKeys, flags: flagWrite},
+	"SETBIT":      {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"SINTERSTORE": {arity: -3, forward: true, keys: allKeys, flags: flagWrite},
+	"SUNIONSTORE": {arity: -3, forward: true, keys: allKeys, flags: flagWrite},
+	"SWAPDB":      {arity: 3, forward: true, flags: flagWrite},
+	"ZDIFFSTORE":  {arity: -4, forward: true, keys: storeKeys, flags: flagWrite},
+	"ZINTERSTORE": {arity: -4, forward: true, keys: storeKeys, flags: flagWrite},
+	"ZRANGESTORE": {arity: -5, forward: true, keys: twoKeys, flags: flagWrite},
+	"ZUNIONSTORE": {arity: -4, forward: true, keys: storeKeys, flags: flagWrite},
+
+	// Writes of other types, also only forwarded in pass-through mode. They
+	// keep replicas from serving reads of the keys until they have the write,
+	// see ReplicaSet.fence.
+	"HDEL":             {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"HINCRBY":          {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"HINCRBYFLOAT":     {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"HMSET":            {arity: -4, forward: true, keys: oneKey, flags: flagWrite},
+	"HSET":             {arity: -4, forward: true, keys: oneKey, flags: flagWrite},
+	"HSETNX":           {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"LINSERT":          {arity: 5, forward: true, keys: oneKey, flags: flagWrite},
+	"LMOVE":            {arity: 5, forward: true, keys: twoKeys, flags: flagWrite},
+	"LPOP":             {arity: -2, forward: true, keys: oneKey, flags: flagWrite},
+	"LPUSH":            {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"LPUSHX":           {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"LREM":             {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"LSET":             {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"LTRIM":            {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"RPOP":             {arity: -2, forward: true, keys: oneKey, flags: flagWrite},
+	"RPOPLPUSH":        {arity: 3, forward: true, keys: twoKeys, flags: flagWrite},
+	"RPUSH":            {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"RPUSHX":           {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"SADD":             {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"SMOVE":            {arity: 4, forward: true, keys: twoKeys, flags: flagWrite},
+	"SPOP":             {arity: -2, forward: true, keys: oneKey, flags: flagWrite},
+	"SREM":             {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"XADD":             {arity: -5, forward: true, keys: oneKey, flags: flagWrite},
+	"XDEL":             {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"XTRIM":            {arity: -4, forward: true, keys: oneKey, flags: flagWrite},
+	"ZADD":             {arity: -4, forward: true, keys: oneKey, flags: flagWrite},
+	"ZINCRBY":          {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"ZPOPMAX":          {arity: -2, forward: true, keys: oneKey, flags: flagWrite},
+	"ZPOPMIN":          {arity: -2, forward: true, keys: oneKey, flags: flagWrite},
+	"ZREM":             {arity: -3, forward: true, keys: oneKey, flags: flagWrite},
+	"ZREMRANGEBYRANK":  {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+	"ZREMRANGEBYSCORE": {arity: 4, forward: true, keys: oneKey, flags: flagWrite},
+
+	"CLIENT":         {arity: -2},
+	"CLIENT|GETNAME": {arity: 2, handler: clientGetNameHandler},
+	"CLIENT|ID":      {arity: 2, handler: clientIDHandler},
+	"CLIENT|SETINFO": {arity: 4, handler: clientSetInfoHandler},
+	"CLIENT|SETNAME": {arity: 3, handler: clientSetNameHandler},
+
+	"CLUSTER":       {arity: -2},
+	"CLUSTER|SLOTS": {arity: 2, forward: true},
+
+	"CONFIG":     {arity: -2},
+	"CONFIG|GET": {arity: -3, forward: true},
+
+	"MEMORY":       {arity: -2},
+	"MEMORY|USAGE": {arity: -3, forward: true, keys: subcommandKey, flags: flagRead},
+
+	"OBJECT":          {arity: -2},
+	"OBJECT|ENCODING": {arity: 3, forward: true, keys: subcommandKey, flags: flagRead},
+	"OBJECT|FREQ":     {arity: 3, forward: true, keys: subcommandKey, flags: flagRead},
+	"OBJECT|IDLETIME": {arity: 3, forward: true, keys: subcommandKey, flags: flagRead},
+	"OBJECT|REFCOUNT": {arity: 3, forward: true, keys: subcommandKey, flags: flagRead},
+
+	"SCRIPT":        {arity: -2},
+	"SCRIPT|EXISTS": {arity: -3, forward: true},
+	"SCRIPT|LOAD":   {arity: 3, forward: true},
+}
+
+// isContainer reports whether the spec only groups subcommands.
+func (spec *commandSpec) isContainer() bool {
+	return spec.handler == nil && !spec.forward
+}
+
+// checkArity reports whether the command has an acceptable number of words.
+func (spec *commandSpec) checkArity(command *Command) bool {
+	words := len(command.Args) + 1
+	if spec.arity < 0 {
+		return words >= -spec.arity
+	}
+	return words == spec.arity
+}
+
+// lookupCommand finds the spec for a command, descending into the subcommands
+// of container commands, and returns it with the command's full name, e.g.
+// CLIENT|SETNAME. The spec is nil if the proxy doesn't know the command. A
+// container called without a subcommand returns the container's own spec,
+// which will fail the arity check.
+func lookupCommand(command *Command) (*commandSpec, string) {
+	spec, exists := commandTable[command.Name]
+	if !exists {
+		return nil, command.Name
+	}
+	if !spec.isContainer() || len(command.Args) == 0 {
+		return spec, command.Name
+	}
+	name := command.Name + "|" + strings.ToUpper(command.Args[0])
+	return commandTable[name], name
+}
+
+// unknownError returns the reply Redis gives for a command, or subcommand,
+// that it doesn't implement.
+func unknownError(command *Command, name string) Error {
+	if !strings.Contains(name, "|") {
+		return unknownCommandError(command)
+	}
+	return Error(fmt.Sprintf("ERR unknown subcommand '%s'. Try %s HELP.",
+		truncate(command.Args[0], maxErrorArgsLength), command.Name))
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupCommand(t *testing.T) {
+	spec, name := lookupCommand(&Command{Name: "GET", Args: []string{"foo"}})
+	assert.NotNil(t, spec)
+	assert.Equal(t, "GET", name)
+
+	spec, name = lookupCommand(&Command{Name: "CLIENT", Args: []string{"setname", "worker"}})
+	assert.NotNil(t, spec)
+	assert.Equal(t, "CLIENT|SETNAME", name)
+
+	spec, name = lookupCommand(&Command{Name: "CLIENT", Args: []string{"kill"}})
+	assert.Nil(t, spec)
+	assert.Equal(t, "CLIENT|KILL", name)
+
+	spec, name = lookupCommand(&Command{Name: "FOO"})
+	assert.Nil(t, spec)
+	assert.Equal(t, "FOO", name)
+}
+
+func TestProcessCommandArity(t *testing.T) {
+	server := NewServer(nil, nil, &Options{})
+	sess := server.newSession(nil)
+
+	resp := server.processCommand(sess, &Command{Name: "GET"})
+	assert.Equal(t, Error("ERR wrong number of arguments for 'get' command"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT"})
+	assert.Equal(t, Error("ERR wrong number of arguments for 'client' command"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"SETNAME"}})
+	assert.Equal(t, Error("ERR wrong number of arguments for 'client|setname' command"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"kill", "x"}})
+	assert.Equal(t, Error("ERR unknown subcommand 'kill'. Try CLIENT HELP."), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "PING", Args: []string{"a", "b"}})
+	assert.Equal(t, Error("ERR wrong number of arguments for 'ping' command"), resp)
+}
+
+func TestProcessCommandSubcommands(t *testing.T) {
+	server := NewServer(nil, nil, &Options{})
+	sess := server.newSession(nil)
+
+	resp := server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"GETNAME"}})
+	assert.Equal(t, NullBulk, resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"setname", "my worker"}})
+	assert.Equal(t, invalidClientNameError, resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"setname", "worker"}})
+	assert.Equal(t, SimpleString("OK"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"getname"}})
+	assert.Equal(t, BulkString("worker"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"id"}})
+	assert.Equal(t, Integer(sess.id), resp)
+}
+
+func TestPassthroughSubcommands(t *testing.T) {
+	server := NewServer(nil, nil, &Options{Passthrough: true})
+	sess := server.newSession(nil)
+
+	resp := server.processCommand(sess, &Command{Name: "CONFIG", Args: []string{"set", "maxmemory", "0"}})
+	assert.Equal(t, Error("ERR command 'config|set' is not allowed through the proxy"), resp)
+
+	resp = server.processCommand(sess, &Command{Name: "CLIENT", Args: []string{"list"}})
+	assert.Equal(t, Error("ERR command 'client|list' is not allowed through the proxy"), resp)
+}
+
+func TestKeysOf(t *testing.T) {
+	command := &Command{Name: "MSET", Args: []string{"a", "1", "b", "2"}}
+	assert.Equal(t, []string{"a", "b"}, pairKeys.keysOf(command))
+	assert.Equal(t, []string{"a", "1", "b", "2"}, allKeys.keysOf(command))
+	assert.Equal(t, []string{"a"}, oneKey.keysOf(command))
+	assert.Equal(t, []string{"a", "1"}, twoKeys.keysOf(command))
+	assert.Equal(t, []string{"1"}, subcommandKey.keysOf(command))
+	assert.Nil(t, keySpec{}.keysOf(command))
+
+	zunion := &Command{Name: "ZUNIONSTORE", Args: []string{"dest", "2", "a", "b", "WEIGHTS", "1", "2"}}
+	assert.Equal(t, []string{"dest", "a", "b"}, storeKeys.keysOf(zunion))
+	eval := &Command{Name: "EVAL", Args: []string{"return 1", "1", "a", "arg"}}
+	assert.Equal(t, []string{"a"}, scriptKeys.keysOf(eval))
+	// Counts past the end take what's there.
+	assert.Equal(t, []string{"a", "arg"}, scriptKeys.keysOf(&Command{Name: "EVAL", Args: []string{"return 1", "5", "a", "arg"}}))
+	assert.Nil(t, scriptKeys.keysOf(&Command{Name: "EVAL", Args: []string{"return 1", "x"}}))
+
+	// Only the destination is written.
+	assert.Equal(t, []string{"dest"}, writtenKeys(zunion))
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// writeHandler forwards a write to the backend and then brings the cache in
+// line with it, so reads through the proxy see writes made through it.
+//
+// Writes to the same key are serialised from the forward to the cache update,
+// so that the cache ends up with the value of whichever reached the backend
+// last.
+var writeHandler handler = func(sess *session, command *Command) (Reply, error) {
+	unlock := sess.server.keyLocks.lock(command)
+	defer unlock()
+
+	resp, err := forwardSplit(sess.server, sess.server.redisClient, command)
+	if err != nil {
+		// The write may or may not have been applied.
+		sess.server.applyWrite(command, nil)
+		return nil, err
+	}
+	sess.server.applyWrite(command, resp)
+	return resp, nil
+}
+
+// applyWrite updates or invalidates the cache entries of the keys written by
+// command, given the reply the backend sent for it. Commands that may write
+// keys they don't name drop the whole cache, see flushCommands.
+//
+// GETs that were already in flight when the write happened may return the
+// old value after we're done here. Bumping writeEpoch under the write lock
+// tells them not to cache it, see getKeys.
+func (s *Server) applyWrite(command *Command, resp Reply) {
+	if flushCommands[command.Name] {
+		s.flush()
+		if s.opt.Replicas != nil {
+			s.opt.Replicas.fenceAll()
+		}
+		return
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	atomic.AddUint64(&s.writeEpoch, 1)
+
+	values := writtenValues(command, resp)
+	keys := writtenKeys(command)
+	if s.opt.Replicas != nil {
+		// Replicas may not have the write yet.
+		s.opt.Replicas.fence(keys)
+	}
+	for _, key := range keys {
+		// Reads of the key from now on must not be answered by a fetch that
+		// started before the write.
+		s.flights.forget(flightKey{s.db, key})
+		s.negative.Remove(key)
+		if val, ok := values[key]; ok {
+			s.cache.Add(key, val, 0)
+		} else {
+			s.cache.Remove(key)
+		}
+	}
+}
+
+// flushCommands may write keys other than those they name: scripts, which
+// can call anything, and commands that replace a whole database. The cache is
+// flushed after them.
+var flushCommands = map[string]bool{
+	"EVAL": true, "EVALSHA": true, "FCALL": true, "FLUSHALL": true,
+	"FLUSHDB": true, "SWAPDB": true,
+}
+
+// keyLockCount is the number of locks keys are spread over by keyLocks.
+const keyLockCount = 256
+
+// keyLocks serialises writes to the same key. Keys are hashed onto a fixed
+// number of locks, so unrelated keys occasionally wait on each other.
+type keyLocks [keyLockCount]sync.Mutex
+
+// lock takes the locks of the keys written by command, or every lock for a
+// flushCommand, and returns a function that releases them. Locks are taken in
+// order, so writes to several keys can't deadlock.
+func (l *keyLocks) lock(command *Command) func() {
+	var stripes []int
+	if flushCommands[command.Name] {
+		stripes = make([]int, keyLockCount)
+		for i := range stripes {
+			stripes[i] = i
+		}
+	} else {
+		seen := make(map[int]bool)
+		for _, key := range writtenKeys(command) {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			stripe := int(h.Sum32() % keyLockCount)
+			if !seen[stripe] {
+				seen[stripe] = true
+				stripes = append(stripes, stripe)
+			}
+		}
+		sort.Ints(stripes)
+	}
+
+	for _, stripe := range stripes {
+		l[stripe].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			l[stripes[i]].Unlock()
+		}
+	}
+}
+
+// writtenKeys returns the keys a write command modifies.
+func writtenKeys(command *Command) []string {
+	args := command.Args
+	switch command.Name {
+	case "DEL", "UNLINK", "RENAME", "RENAMENX":
+		return args
+	case "COPY", "LMOVE", "RPOPLPUSH", "SMOVE":
+		return args[:2]
+	case "BITOP":
+		return args[1:2]
+	case "MSET", "MSETNX":
+		keys := make([]string, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+	return args[:1]
+}
+
+// writtenValues returns the new values of keys whose value is known from a
+// successful write and its reply. Any other written key is invalidated.
+func writtenValues(command *Command, resp Reply) map[string]string {
+	args := command.Args
+	switch command.Name {
+	case "SET":
+		// Options such as EX or NX change what happened, so only the plain form
+		// is cached. Like GETSET and MSET it clears any TTL the key had.
+		if len(args) == 2 && resp == SimpleString("OK") {
+			return map[string]string{args[0]: args[1]}
+		}
+	case "GETSET":
+		if _, ok := resp.(Error); !ok && resp != nil {
+			return map[string]string{args[0]: args[1]}
+		}
+	case "MSET":
+		if resp == SimpleString("OK") {
+			values := make(map[string]string, len(args)/2)
+			for i := 0; i+1 < len(args); i += 2 {
+				values[args[i]] = args[i+1]
+			}
+			return values
+		}
+	}
+	// INCR and the like keep the key's TTL, which we don't know, so they are
+	// invalidated rather than cached with the wrong one.
+	return nil
+}
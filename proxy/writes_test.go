@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eastside-eng/redis-proxy/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrittenKeys(t *testing.T) {
+	assert.Equal(t, []string{"a"}, writtenKeys(&Command{Name: "SET", Args: []string{"a", "1", "EX", "10"}}))
+	assert.Equal(t, []string{"a", "b"}, writtenKeys(&Command{Name: "DEL", Args: []string{"a", "b"}}))
+	assert.Equal(t, []string{"a", "b"}, writtenKeys(&Command{Name: "MSET", Args: []string{"a", "1", "b", "2"}}))
+	assert.Equal(t, []string{"a", "b"}, writtenKeys(&Command{Name: "RENAME", Args: []string{"a", "b"}}))
+	assert.Equal(t, []string{"a", "b"}, writtenKeys(&Command{Name: "COPY", Args: []string{"a", "b", "REPLACE"}}))
+	assert.Equal(t, []string{"dest"}, writtenKeys(&Command{Name: "BITOP", Args: []string{"AND", "dest", "a", "b"}}))
+}
+
+func TestWrittenValues(t *testing.T) {
+	set := &Command{Name: "SET", Args: []string{"a", "1"}}
+	assert.Equal(t, map[string]string{"a": "1"}, writtenValues(set, SimpleString("OK")))
+	assert.Nil(t, writtenValues(set, Error("ERR oops")))
+
+	setNX := &Command{Name: "SET", Args: []string{"a", "1", "NX"}}
+	assert.Nil(t, writtenValues(setNX, SimpleString("OK")))
+
+	// INCRBY keeps the key's TTL, so its value isn't cached.
+	incr := &Command{Name: "INCRBY", Args: []string{"a", "5"}}
+	assert.Nil(t, writtenValues(incr, Integer(7)))
+
+	mset := &Command{Name: "MSET", Args: []string{"a", "1", "b", "2"}}
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, writtenValues(mset, SimpleString("OK")))
+
+	assert.Nil(t, writtenValues(&Command{Name: "APPEND", Args: []string{"a", "1"}}, Integer(2)))
+}
+
+func TestApplyWrite(t *testing.T) {
+	lru, _ := cache.NewDecayingLRUCache(10, time.Second, time.Minute)
+	server := NewServer(lru, nil, &Options{})
+	lru.Add("a", "old", 0)
+	lru.Add("b", "old", 0)
+
+	server.applyWrite(&Command{Name: "SET", Args: []string{"a", "new"}}, SimpleString("OK"))
+	val, exists := lru.Get("a")
+	assert.True(t, exists)
+	assert.Equal(t, "new", val)
+
+	server.applyWrite(&Command{Name: "APPEND", Args: []string{"b", "er"}}, Integer(5))
+	_, exists = lru.Get("b")
+	assert.False(t, exists)
+
+	// A failed write invalidates, as we can't know whether it was applied.
+	server.applyWrite(&Command{Name: "SET", Args: []string{"a", "newer"}}, nil)
+	_, exists = lru.Get("a")
+	assert.False(t, exists)
+	assert.Equal(t, uint64(3), server.writeEpoch)
+}
+
+func TestKeyLocks(t *testing.T) {
+	var locks keyLocks
+	unlock := locks.lock(&Command{Name: "MSET", Args: []string{"a", "1", "b", "2"}})
+
+	locked := make(chan struct{})
+	go func() {
+		defer locks.lock(&Command{Name: "SET", Args: []string{"b", "3"}})()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Write to a locked key didn't wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	// Flushes wait for every write, and writes to keys in the same stripe
+	// don't deadlock.
+	locks.lock(&Command{Name: "FLUSHALL"})()
+	locks.lock(&Command{Name: "DEL", Args: []string{"a", "a"}})()
+}
+
+func TestApplyFlushingWrite(t *testing.T) {
+	lru, _ := cache.NewDecayingLRUCache(10, time.Second, time.Minute)
+	server := NewServer(lru, nil, &Options{})
+	lru.Add("a", "old", 0)
+
+	// A script may write any key.
+	server.applyWrite(&Command{Name: "EVAL", Args: []string{"return 1", "0"}}, Integer(1))
+	_, exists := lru.Get("a")
+	assert.False(t, exists)
+	assert.Equal(t, uint64(1), server.writeEpoch)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
@@ -126,3 +128,225 @@ func TestLRU(t *testing.T) {
 		}
 	}
 }
+
+func TestPipeline(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+	})
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("pipeline%d", i)
+		assert.Equal(t, "OK", client.Set(key, key, time.Minute*10).Val())
+	}
+
+	// Replies must come back in the order the commands were sent, whether they
+	// were served from the cache or the backing Redis.
+	proxy.Get("pipeline50")
+	pipe := proxy.Pipeline()
+	cmds := make([]*redis.StringCmd, 100)
+	for i := 0; i < 100; i++ {
+		cmds[i] = pipe.Get(fmt.Sprintf("pipeline%d", i))
+	}
+	pipe.Ping()
+	_, err := pipe.Exec()
+	assert.Nil(t, err)
+
+	for i, cmd := range cmds {
+		assert.Equal(t, fmt.Sprintf("pipeline%d", i), cmd.Val())
+	}
+}
+
+// The docker-compose setup runs the proxy in passthrough mode.
+func TestPassthrough(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+	})
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	client.Del("passthrough")
+	assert.Equal(t, int64(1), proxy.HSet("passthrough", "field", "value").Val())
+	assert.Equal(t, "value", client.HGet("passthrough", "field").Val())
+	assert.Equal(t, map[string]string{"field": "value"}, proxy.HGetAll("passthrough").Val())
+	assert.Equal(t, "hash", proxy.Type("passthrough").Val())
+
+	// A GET against the wrong type is relayed as an error, not a nil.
+	assert.Equal(t, "WRONGTYPE Operation against a key holding the wrong kind of value",
+		proxy.Get("passthrough").Err().Error())
+
+	// Denied commands are refused.
+	assert.NotNil(t, proxy.FlushAll().Err())
+}
+
+func TestWriteThrough(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+	})
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	// Cache a value, then overwrite it through the proxy.
+	assert.Equal(t, "OK", client.Set("writes", "1", time.Minute*10).Val())
+	assert.Equal(t, "1", proxy.Get("writes").Val())
+	assert.Equal(t, "OK", proxy.Set("writes", "2", 0).Val())
+	assert.Equal(t, "2", proxy.Get("writes").Val())
+	assert.Equal(t, "2", client.Get("writes").Val())
+
+	assert.Equal(t, int64(5), proxy.IncrBy("writes", 3).Val())
+	assert.Equal(t, "5", proxy.Get("writes").Val())
+
+	assert.Equal(t, int64(2), proxy.Append("writes", "0").Val())
+	assert.Equal(t, "50", proxy.Get("writes").Val())
+
+	assert.Equal(t, int64(1), proxy.Del("writes").Val())
+	assert.Equal(t, redis.Nil, proxy.Get("writes").Err())
+}
+
+func TestMGet(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+	})
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	assert.Equal(t, "OK", client.MSet("mget1", "1", "mget2", "2", "mget3", "3").Val())
+	client.Del("mget4")
+
+	// Cache one of the keys, then change it in the backing Redis.
+	assert.Equal(t, "2", proxy.Get("mget2").Val())
+	assert.Equal(t, "OK", client.Set("mget2", "stale", 0).Val())
+
+	vals, err := proxy.MGet("mget1", "mget2", "mget3", "mget4").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"1", "2", "3", nil}, vals)
+
+	// The misses were cached too.
+	assert.Equal(t, "OK", client.Set("mget3", "stale", 0).Val())
+	assert.Equal(t, "3", proxy.Get("mget3").Val())
+}
+
+func TestBackendTTL(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+	})
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	// The key expires in Redis well before the proxy's TTL, and the cached
+	// value must go with it.
+	assert.Equal(t, "OK", client.Set("short-lived", "1", time.Millisecond*500).Val())
+	assert.Equal(t, "1", proxy.Get("short-lived").Val())
+	assert.Equal(t, []interface{}{"1"}, proxy.MGet("short-lived").Val())
+	time.Sleep(time.Second)
+	assert.Equal(t, redis.Nil, proxy.Get("short-lived").Err())
+}
+
+func TestCoalescing(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+		PoolSize: 50,
+	})
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	assert.Equal(t, "OK", client.Set("herd", "1", time.Minute*10).Val())
+
+	// Every concurrent miss gets the value, however many fetches it took.
+	out := make(chan string)
+	for i := 0; i < 50; i++ {
+		go func() {
+			out <- proxy.Get("herd").Val()
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, "1", <-out)
+	}
+	assert.Contains(t, proxy.Info("stats").Val(), "coalesced_requests:")
+}
+
+func TestExists(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+	})
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	client.Del("exists-missing")
+	assert.Equal(t, "OK", client.Set("exists-present", "1", time.Minute*10).Val())
+	assert.Equal(t, redis.Nil, proxy.Get("exists-missing").Err())
+	assert.Equal(t, int64(1), proxy.Exists("exists-present", "exists-missing").Val())
+
+	// Writes through the proxy are seen even if the key was cached as missing.
+	assert.Equal(t, "OK", proxy.Set("exists-missing", "1", 0).Val())
+	assert.Equal(t, "1", proxy.Get("exists-missing").Val())
+	assert.Equal(t, int64(2), proxy.Exists("exists-present", "exists-missing").Val())
+}
+
+func TestQuit(t *testing.T) {
+	proxy := redis.NewClient(&redis.Options{
+		Addr:     "localhost:8001",
+		Password: "",
+		DB:       0,
+	})
+
+	// QUIT closes the client's connection, and never reaches a pooled
+	// backend connection that other clients would then find closed.
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", "localhost:8001")
+		assert.Nil(t, err)
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("QUIT\r\n"))
+		line, _ := reader.ReadString('\n')
+		assert.Equal(t, "+OK\r\n", line)
+		_, err = reader.ReadString('\n')
+		assert.NotNil(t, err)
+		conn.Close()
+
+		assert.Equal(t, int64(1), proxy.HSet("quit", "field", "value").Val())
+		assert.Equal(t, int64(1), proxy.HDel("quit", "field").Val())
+	}
+}